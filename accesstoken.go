@@ -0,0 +1,223 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultScopeHeader    = "kubeflow-scope"
+	defaultClientIDHeader = "kubeflow-client-id"
+)
+
+// accessTokenConfig enables the validation of JWT access tokens, as described
+// in RFC 9068, and is read from ACCESS_TOKEN_CONFIG_PATH.
+// See: https://tools.ietf.org/html/rfc9068
+type accessTokenConfig struct {
+	// Audiences are the resource identifiers of the services behind the
+	// authservice. An access token must have one of them in its aud claim.
+	Audiences []string `yaml:"audiences"`
+	// Scopes lists the scopes that requests need. The first rule that
+	// matches the request applies, requests that don't match any rule
+	// don't need any scopes.
+	Scopes []scopeRule `yaml:"scopes"`
+	// ScopeHeader and ClientIDHeader are the headers that carry the scope
+	// and client_id claims of the access token.
+	ScopeHeader    string `yaml:"scopeHeader"`
+	ClientIDHeader string `yaml:"clientIDHeader"`
+}
+
+type scopeRule struct {
+	PathPrefix string `yaml:"pathPrefix"`
+	// Methods to match. Empty matches all methods.
+	Methods []string `yaml:"methods"`
+	// Require holds the scopes that the access token must all have.
+	Require []string `yaml:"require"`
+}
+
+func loadAccessTokenConfig(path string) (*accessTokenConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading access token config")
+	}
+	return parseAccessTokenConfig(data)
+}
+
+func parseAccessTokenConfig(data []byte) (*accessTokenConfig, error) {
+	config := &accessTokenConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrap(err, "error parsing access token config")
+	}
+	if len(config.Audiences) == 0 {
+		return nil, errors.New("access token config must have at least one audience")
+	}
+	if config.ScopeHeader == "" {
+		config.ScopeHeader = defaultScopeHeader
+	}
+	if config.ClientIDHeader == "" {
+		config.ClientIDHeader = defaultClientIDHeader
+	}
+	return config, nil
+}
+
+func (rule *scopeRule) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredScopes returns the scopes that the request needs.
+func (c *accessTokenConfig) requiredScopes(r *http.Request) []string {
+	for i := range c.Scopes {
+		if c.Scopes[i].matches(r) {
+			return c.Scopes[i].Require
+		}
+	}
+	return nil
+}
+
+// missingScopes returns the required scopes that are not in the
+// space-separated scope claim.
+func missingScopes(required []string, scope string) []string {
+	granted := map[string]bool{}
+	for _, s := range strings.Fields(scope) {
+		granted[s] = true
+	}
+	missing := []string{}
+	for _, s := range required {
+		if !granted[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// isAccessTokenJWT returns true if the JWT's typ header marks it as an access
+// token.
+func isAccessTokenJWT(rawToken string) bool {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	header := struct {
+		Type string `json:"typ"`
+	}{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return false
+	}
+	typ := strings.ToLower(header.Type)
+	return typ == "at+jwt" || typ == "application/at+jwt"
+}
+
+// verifyAccessToken verifies a JWT access token and returns its claims, as
+// described in: https://tools.ietf.org/html/rfc9068#section-4
+// Access tokens are accepted from the same issuers as ID tokens, but they
+// must be issued for one of the configured audiences instead of a client.
+func (s *server) verifyAccessToken(ctx context.Context, providers []*oidcProvider, rawToken string) (*bearerIssuer, map[string]interface{}, error) {
+	bi, err := s.bearerIssuerFor(ctx, providers, rawToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifyCtx, span := startSpan(ctx, "oidc.VerifyToken")
+	token, err := bi.verifier.Verify(verifyCtx, rawToken)
+	endSpan(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !containsAnyString(s.accessTokens.Audiences, token.Audience) {
+		return nil, nil, errors.Errorf("access token audience %v is not accepted", token.Audience)
+	}
+	claims := map[string]interface{}{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, nil, errors.Wrap(err, "error parsing access token claims")
+	}
+	for _, claim := range []string{"sub", "client_id", "iat", "jti"} {
+		if _, ok := claims[claim]; !ok {
+			return nil, nil, errors.Errorf("access token doesn't have a %s claim", claim)
+		}
+	}
+	if _, ok := claims["scope"]; ok {
+		if _, ok := claims["scope"].(string); !ok {
+			return nil, nil, errors.New("access token scope claim is not a string")
+		}
+	}
+	return bi, claims, nil
+}
+
+// accessTokenClaims verifies a JWT access token and returns its claims and
+// the claim with the userid. If the token is rejected, it writes the response
+// and returns false.
+func (s *server) accessTokenClaims(w http.ResponseWriter, r *http.Request, providers []*oidcProvider, rawToken string) (map[string]interface{}, string, bool) {
+	logger := loggerForRequest(r)
+
+	issuer, claims, err := s.verifyAccessToken(r.Context(), providers, rawToken)
+	if err != nil {
+		logger.Errorf("Not able to verify access token: %v", err)
+		reason := "invalid_access_token"
+		if errors.Cause(err) == errUntrustedIssuer {
+			reason = "untrusted_issuer"
+		}
+		s.bearerRejected(r, reason)
+		requestsTotal.WithLabelValues(outcomeUnauthenticated, "invalid_bearer_token").Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		returnStatus(w, http.StatusUnauthorized, "Unable to verify access token.")
+		return nil, "", false
+	}
+	return claims, issuer.userIDClaim, true
+}
+
+// authorizeScopes checks that the request has the scopes it needs, given the
+// space-separated scopes granted to its token. Only access tokens, verified
+// or introspected, grant scopes, so requests authenticated in other ways
+// (ID tokens, sessions, ServiceAccount tokens) are denied on the paths that
+// need scopes. If the request is denied, it writes a 403 response and
+// returns false.
+func (s *server) authorizeScopes(w http.ResponseWriter, r *http.Request, scope string) bool {
+	if s.accessTokens == nil {
+		return true
+	}
+	required := s.accessTokens.requiredScopes(r)
+	missing := missingScopes(required, scope)
+	if len(missing) == 0 {
+		return true
+	}
+	loggerForRequest(r).Infof("Request doesn't have the required scopes %v", missing)
+	requestsTotal.WithLabelValues(outcomeDenied, "insufficient_scope").Inc()
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(required, " ")))
+	returnStatus(w, http.StatusForbidden, "Forbidden: missing scopes "+strings.Join(missing, " "))
+	return false
+}
+
+// setAccessTokenHeaders adds the scope and client_id claims of an access token
+// to the response headers.
+func (s *server) setAccessTokenHeaders(w http.ResponseWriter, claims map[string]interface{}) {
+	if scope, ok := claims["scope"].(string); ok {
+		w.Header().Set(s.accessTokens.ScopeHeader, scope)
+	}
+	if clientID, ok := claims["client_id"].(string); ok {
+		w.Header().Set(s.accessTokens.ClientIDHeader, clientID)
+	}
+}
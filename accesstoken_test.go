@@ -0,0 +1,153 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// signAccessToken returns a JWT access token with the given claims, signed by
+// the provider.
+func (p *testProvider) signAccessToken(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: p.key, KeyID: "test"},
+	}, (&jose.SignerOptions{}).WithType("at+jwt"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating signer: %v", err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatalf("Unexpected error signing token: %v", err)
+	}
+	return token
+}
+
+const testAccessTokenConfig = `
+audiences: [https://api.example.com]
+scopes:
+- pathPrefix: /api/models
+  methods: [POST, DELETE]
+  require: [models:write]
+- pathPrefix: /api/models
+  require: [models:read]
+`
+
+func TestAccessTokens(t *testing.T) {
+	config, err := parseAccessTokenConfig([]byte(testAccessTokenConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %+v", err)
+	}
+	idp := newTestProvider(t)
+	s := &server{
+		providers:    []*oidcProvider{idp.provider(t, defaultProviderName)},
+		accessTokens: config,
+		userIDOpts:   userIDOpts{header: "kubeflow-userid"},
+	}
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":       idp.URL,
+			"sub":       "alice",
+			"aud":       "https://api.example.com",
+			"client_id": "cli",
+			"scope":     "openid models:read",
+			"iat":       time.Now().Unix(),
+			"exp":       time.Now().Add(time.Minute).Unix(),
+			"jti":       "1",
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"read", "GET", "/api/models", idp.signAccessToken(t, claims(nil)), http.StatusOK},
+		{"no scopes needed", "GET", "/other", idp.signAccessToken(t, claims(map[string]interface{}{"scope": nil})), http.StatusOK},
+		{"missing write scope", "POST", "/api/models", idp.signAccessToken(t, claims(nil)), http.StatusForbidden},
+		{"write", "POST", "/api/models", idp.signAccessToken(t, claims(map[string]interface{}{"scope": "models:write"})), http.StatusOK},
+		{"wrong audience", "GET", "/api/models", idp.signAccessToken(t, claims(map[string]interface{}{"aud": "authservice"})), http.StatusUnauthorized},
+		{"missing client_id", "GET", "/api/models", idp.signAccessToken(t, claims(map[string]interface{}{"client_id": nil})), http.StatusUnauthorized},
+		{"missing jti", "GET", "/api/models", idp.signAccessToken(t, claims(map[string]interface{}{"jti": nil})), http.StatusUnauthorized},
+		{"expired", "GET", "/api/models", idp.signAccessToken(t, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), http.StatusUnauthorized},
+		// ID tokens are still verified as before, but they don't grant
+		// scopes, even if they have a scope claim
+		{"id token", "GET", "/other", idp.sign(t, claims(map[string]interface{}{"aud": "authservice"})), http.StatusOK},
+		{"id token without scopes", "GET", "/api/models", idp.sign(t, claims(map[string]interface{}{"aud": "authservice"})), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+			s.authenticate(w, r)
+			if w.Code != test.status {
+				t.Fatalf("Got status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+		})
+	}
+
+	// The scope and client_id are passed on in headers
+	r := httptest.NewRequest("GET", "/api/models", nil)
+	r.Header.Set("Authorization", "Bearer "+idp.signAccessToken(t, claims(nil)))
+	w := httptest.NewRecorder()
+	s.authenticate(w, r)
+	for header, want := range map[string]string{
+		"kubeflow-userid":    "alice",
+		"kubeflow-scope":     "openid models:read",
+		"kubeflow-client-id": "cli",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("Got %s header %q, want %q", header, got, want)
+		}
+	}
+
+	// Sessions don't grant scopes either
+	backend := newMemoryStore()
+	s.backend = backend
+	s.store = newStoreAdapter(backend, 60, []byte("key"))
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice"
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice", "scope": "models:read"}
+	session.Values[userSessionProvider] = defaultProviderName
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	for path, status := range map[string]int{"/api/models": http.StatusForbidden, "/other": http.StatusOK} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(login.Result().Cookies()[0])
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		if w.Code != status {
+			t.Errorf("Session request to %s got status %d, want %d", path, w.Code, status)
+		}
+	}
+
+	// Access tokens are never accepted as ID tokens, even if issued to us
+	s.accessTokens = nil
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+idp.signAccessToken(t, claims(map[string]interface{}{"aud": "authservice"})))
+	w = httptest.NewRecorder()
+	s.authenticate(w, r)
+	if w.Code == http.StatusOK {
+		t.Error("Access token was accepted as an ID token")
+	}
+}
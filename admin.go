@@ -0,0 +1,208 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// adminSession is the view of a user session returned by the admin API.
+type adminSession struct {
+	// ID is a handle for the session. It is not the session id itself, which
+	// would allow impersonating the user.
+	ID        string                 `json:"id"`
+	UserID    string                 `json:"userid"`
+	IP        string                 `json:"ip,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	ExpiresAt time.Time              `json:"expiresAt"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+}
+
+// sessionHandle returns the handle of the session with the given id.
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+func newAdminSession(rec *sessionRecord, withClaims bool) adminSession {
+	res := adminSession{
+		ID:        sessionHandle(rec.ID),
+		UserID:    rec.UserID,
+		CreatedAt: rec.CreatedAt,
+		ExpiresAt: rec.ExpiresAt,
+	}
+	res.IP, _ = rec.Values[userSessionIP].(string)
+	if withClaims {
+		res.Claims, _ = rec.Values[userSessionClaims].(map[string]interface{})
+	}
+	return res
+}
+
+// adminHandler returns the handler of the admin API, which lets operators
+// list and revoke user sessions. All requests must carry the admin token as
+// a bearer token.
+func (s *server) adminHandler(token string) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/sessions", s.adminListSessions).Methods(http.MethodGet)
+	router.HandleFunc("/sessions/{id}", s.adminGetSession).Methods(http.MethodGet)
+	router.HandleFunc("/sessions/{id}", s.adminRevokeSession).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{userid}/sessions", s.adminRevokeUserSessions).Methods(http.MethodDelete)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := getBearerToken(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			loggerForRequest(r).Warn("Unauthenticated admin API request")
+			returnStatus(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// listSessions returns the user sessions of the given user, or of all users
+// if userID is empty.
+func (s *server) listSessions(userID string) ([]*sessionRecord, error) {
+	var recs []*sessionRecord
+	var err error
+	if userID != "" {
+		recs, err = s.backend.ListByUser(userID)
+	} else {
+		recs, err = s.backend.List()
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := []*sessionRecord{}
+	for _, rec := range recs {
+		if rec.Kind == recordKindSession {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// findSession returns the user session with the given handle.
+func (s *server) findSession(handle string) (*sessionRecord, error) {
+	recs, err := s.listSessions("")
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		if subtle.ConstantTimeCompare([]byte(sessionHandle(rec.ID)), []byte(handle)) == 1 {
+			return rec, nil
+		}
+	}
+	return nil, errRecordNotFound
+}
+
+// revokeSession revokes the tokens of the session at the IdP, if the IdP
+// supports it, and deletes the session. The session is deleted even if
+// revoking its tokens fails.
+func (s *server) revokeSession(r *http.Request, rec *sessionRecord) error {
+	var revokeErr error
+	if p := s.recordProvider(rec); p == nil {
+		revokeErr = errors.New("the provider of the session is no longer configured")
+	} else if endpoint, err := revocationEndpoint(p.provider); err == nil {
+		if token, ok := rec.Values[userSessionOAuth2Tokens].(oauth2.Token); ok {
+			ctx := setTLSContext(r.Context(), s.caBundle)
+			revokeErr = revokeTokens(ctx, endpoint, &token, p.oauth2Config.ClientID, p.oauth2Config.ClientSecret)
+		}
+	}
+	if err := s.backend.Delete(rec.ID); err != nil {
+		return errors.Wrap(err, "error deleting session")
+	}
+	s.audit.log(r, recordAuditEvent(auditSessionRevoked, rec, "admin"))
+	return revokeErr
+}
+
+func (s *server) adminListSessions(w http.ResponseWriter, r *http.Request) {
+	recs, err := s.listSessions(r.URL.Query().Get("user"))
+	if err != nil {
+		loggerForRequest(r).Errorf("Couldn't list sessions: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Couldn't list sessions.")
+		return
+	}
+	res := []adminSession{}
+	for _, rec := range recs {
+		res = append(res, newAdminSession(rec, false))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) adminGetSession(w http.ResponseWriter, r *http.Request) {
+	rec, err := s.findSession(mux.Vars(r)["id"])
+	if err == errRecordNotFound {
+		returnStatus(w, http.StatusNotFound, "Session not found.")
+		return
+	}
+	if err != nil {
+		loggerForRequest(r).Errorf("Couldn't get session: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Couldn't get session.")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminSession(rec, true))
+}
+
+func (s *server) adminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	logger := loggerForRequest(r)
+	rec, err := s.findSession(mux.Vars(r)["id"])
+	if err == errRecordNotFound {
+		returnStatus(w, http.StatusNotFound, "Session not found.")
+		return
+	}
+	if err != nil {
+		logger.Errorf("Couldn't get session: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Couldn't get session.")
+		return
+	}
+	logger = logger.WithField("userid", rec.UserID)
+	if err := s.revokeSession(r, rec); err != nil {
+		logger.Errorf("Error revoking session: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Error revoking session.")
+		return
+	}
+	logger.Info("Session revoked by admin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) adminRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userid"]
+	logger := loggerForRequest(r).WithField("userid", userID)
+	recs, err := s.listSessions(userID)
+	if err != nil {
+		logger.Errorf("Couldn't list sessions: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Couldn't list sessions.")
+		return
+	}
+	// Revoke all sessions, even if some of them fail
+	failed := 0
+	for _, rec := range recs {
+		if err := s.revokeSession(r, rec); err != nil {
+			logger.Errorf("Error revoking session: %v", err)
+			failed++
+		}
+	}
+	logger.Infof("%d sessions revoked by admin, %d failed", len(recs)-failed, failed)
+	if failed > 0 {
+		returnStatus(w, http.StatusInternalServerError, "Error revoking some of the user's sessions.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error writing JSON response: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	idp := newTestProvider(t)
+	backend := newMemoryStore()
+	s := &server{
+		providers: []*oidcProvider{idp.provider(t, defaultProviderName)},
+		backend:   backend,
+	}
+	for _, rec := range []*sessionRecord{
+		{ID: "alice-1", Kind: recordKindSession, UserID: "alice", Values: map[interface{}]interface{}{
+			userSessionIP:     "10.0.0.1",
+			userSessionClaims: map[string]interface{}{"email": "alice@example.com"},
+		}},
+		{ID: "alice-2", Kind: recordKindSession, UserID: "alice"},
+		{ID: "bob", Kind: recordKindSession, UserID: "bob"},
+		{ID: "login", Kind: recordKindState},
+	} {
+		rec.CreatedAt = time.Now()
+		if err := backend.Put(rec, time.Minute); err != nil {
+			t.Fatalf("Unexpected error in Put: %+v", err)
+		}
+	}
+	handler := s.adminHandler("secret")
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/sessions", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with wrong token, got %d", w.Code)
+	}
+
+	// List sessions
+	w := do("GET", "/sessions", "secret")
+	list := []adminSession{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Unexpected error decoding response %q: %v", w.Body.String(), err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("Wrong number of sessions. Got %d, expected 3: %+v", len(list), list)
+	}
+	w = do("GET", "/sessions?user=alice", "secret")
+	list = []adminSession{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 2 {
+		t.Fatalf("Wrong number of sessions for alice. Got %d, expected 2: %+v", len(list), list)
+	}
+
+	// Get a session's claims
+	w = do("GET", "/sessions/"+sessionHandle("alice-1"), "secret")
+	session := adminSession{}
+	if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil {
+		t.Fatalf("Unexpected error decoding response %q: %v", w.Body.String(), err)
+	}
+	if session.UserID != "alice" || session.IP != "10.0.0.1" || session.Claims["email"] != "alice@example.com" {
+		t.Fatalf("Wrong session: %+v", session)
+	}
+	if w := do("GET", "/sessions/"+sessionHandle("login"), "secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for login state, got %d", w.Code)
+	}
+
+	// Revoke a user's sessions
+	if w := do("DELETE", "/users/alice/sessions", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("Wrong status revoking sessions. Got %d: %s", w.Code, w.Body.String())
+	}
+	for id, exists := range map[string]bool{"alice-1": false, "alice-2": false, "bob": true} {
+		if _, err := backend.Get(id); (err == nil) != exists {
+			t.Errorf("Session %s exists: %v, expected %v", id, err == nil, exists)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of audit events
+const (
+	auditLoginFailed      = "login_failed"
+	auditSessionCreated   = "session_created"
+	auditSessionRefreshed = "session_refreshed"
+	auditSessionEnded     = "session_ended"
+	auditSessionRevoked   = "session_revoked"
+	auditBearerRejected   = "bearer_rejected"
+)
+
+// auditLogStdout is the AUDIT_LOG value that writes the audit log to stdout.
+const auditLogStdout = "stdout"
+
+// auditEvent is an entry of the audit log. Entries are written as JSON lines
+// and form a hash chain: each entry has the hash of the previous one, so
+// deleting or editing an entry breaks the chain of all entries after it.
+type auditEvent struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	UserID string    `json:"userid,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	// Session is the handle of the session, as used by the admin API.
+	Session string `json:"session,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// PrevHash is the hash of the previous entry, empty for the first one.
+	PrevHash string `json:"prevHash"`
+	// Hash is the SHA-256 of the entry's JSON encoding without the hash,
+	// or its HMAC-SHA256 if the log has a key.
+	Hash string `json:"hash,omitempty"`
+}
+
+func (e auditEvent) computeHash(key []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sessionAuditEvent returns an event about a user session.
+func sessionAuditEvent(typ string, session *sessions.Session, reason string) auditEvent {
+	userID, _ := session.Values[userSessionUserID].(string)
+	return auditEvent{
+		Type:    typ,
+		UserID:  userID,
+		Session: sessionHandle(session.ID),
+		Reason:  reason,
+	}
+}
+
+// recordAuditEvent returns an event about a stored user session.
+func recordAuditEvent(typ string, rec *sessionRecord, reason string) auditEvent {
+	return auditEvent{
+		Type:    typ,
+		UserID:  rec.UserID,
+		Session: sessionHandle(rec.ID),
+		Reason:  reason,
+	}
+}
+
+// auditLogger appends events to the audit log. A nil auditLogger discards
+// all events.
+type auditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+	// key, if set, is the HMAC key of the hashes, so that the chain can't be
+	// recomputed by someone who can edit the log.
+	key      []byte
+	seq      int64
+	lastHash string
+}
+
+// newAuditLogger opens the audit log at path, or stdout. An existing log file
+// is appended to, continuing its hash chain.
+func newAuditLogger(path string, key []byte) (*auditLogger, error) {
+	if path == auditLogStdout {
+		return &auditLogger{w: os.Stdout, key: key}, nil
+	}
+	a := &auditLogger{key: key}
+	if last, err := lastAuditEvent(path); err != nil {
+		return nil, err
+	} else if last != nil {
+		a.seq, a.lastHash = last.Seq, last.Hash
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening audit log")
+	}
+	a.w = f
+	return a, nil
+}
+
+// lastAuditEvent returns the last entry of the audit log at path, or nil if
+// the log doesn't exist or is empty.
+func lastAuditEvent(path string) (*auditEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening audit log")
+	}
+	defer f.Close()
+	var last *auditEvent
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		e := &auditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, errors.Wrapf(err, "invalid audit log entry at line %d", line)
+		}
+		last = e
+	}
+	return last, errors.Wrap(scanner.Err(), "error reading audit log")
+}
+
+// log appends an event to the audit log. The time, the sequence number and
+// the hashes are filled in, as well as the user's IP from the request, if
+// given.
+func (a *auditLogger) log(r *http.Request, e auditEvent) {
+	if a == nil {
+		return
+	}
+	if r != nil && e.IP == "" {
+		e.IP = getUserIP(r)
+	}
+	e.Time = time.Now().UTC()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq = a.seq + 1
+	e.PrevHash = a.lastHash
+	hash, err := e.computeHash(a.key)
+	if err != nil {
+		log.Errorf("Error hashing audit event: %v", err)
+		return
+	}
+	e.Hash = hash
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Error encoding audit event: %v", err)
+		return
+	}
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		log.Errorf("Error writing audit event: %v", err)
+		return
+	}
+	a.seq, a.lastHash = e.Seq, e.Hash
+}
+
+// auditCheckpoint identifies an entry of the audit log by its sequence number
+// and hash, e.g. the last entry of a rotated log file.
+type auditCheckpoint struct {
+	Seq  int64
+	Hash string
+}
+
+func (c auditCheckpoint) String() string {
+	return fmt.Sprintf("%d:%s", c.Seq, c.Hash)
+}
+
+// Set parses a checkpoint in the <seq>:<hash> format, for use as a flag.
+func (c *auditCheckpoint) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.New("checkpoint must be in the <seq>:<hash> format")
+	}
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || seq < 0 {
+		return errors.Errorf("invalid sequence number %q", parts[0])
+	}
+	c.Seq, c.Hash = seq, parts[1]
+	return nil
+}
+
+// verifyAuditLog checks the hash chain of an audit log and returns the number
+// of entries and the last entry.
+// The first entry must start the chain, or follow after, if given, e.g. if
+// the log was rotated. Entries removed from the end of the log can only be
+// detected by comparing the last entry with a checkpoint kept elsewhere.
+func verifyAuditLog(r io.Reader, key []byte, after *auditCheckpoint) (int64, *auditCheckpoint, error) {
+	var prev *auditEvent
+	n := int64(0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		n++
+		e := auditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, nil, errors.Wrapf(err, "line %d: invalid entry", n)
+		}
+		hash, err := e.computeHash(key)
+		if err != nil {
+			return n, nil, errors.Wrapf(err, "line %d: error hashing entry", n)
+		}
+		if !hmac.Equal([]byte(hash), []byte(e.Hash)) {
+			return n, nil, errors.Errorf("line %d: entry %d has been modified", n, e.Seq)
+		}
+		switch {
+		case prev != nil:
+			if e.Seq != prev.Seq+1 {
+				return n, nil, errors.Errorf("line %d: entries %d to %d are missing", n, prev.Seq+1, e.Seq-1)
+			}
+			if e.PrevHash != prev.Hash {
+				return n, nil, errors.Errorf("line %d: entry %d doesn't follow entry %d", n, e.Seq, prev.Seq)
+			}
+		case after != nil:
+			if e.Seq != after.Seq+1 || e.PrevHash != after.Hash {
+				return n, nil, errors.Errorf("line %d: entry %d doesn't follow entry %d", n, e.Seq, after.Seq)
+			}
+		default:
+			if e.Seq != 1 || e.PrevHash != "" {
+				return n, nil, errors.Errorf("line %d: entries before entry %d are missing", n, e.Seq)
+			}
+		}
+		prev = &e
+	}
+	if err := scanner.Err(); err != nil {
+		return n, nil, errors.Wrap(err, "error reading audit log")
+	}
+	if prev == nil {
+		return 0, after, nil
+	}
+	return n, &auditCheckpoint{Seq: prev.Seq, Hash: prev.Hash}, nil
+}
+
+// verifyAuditLogCommand implements the verify-audit-log command.
+// The HMAC key of the log is read from AUDIT_LOG_HMAC_KEY.
+func verifyAuditLogCommand(args []string) {
+	flags := flag.NewFlagSet("verify-audit-log", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: oidc-authservice verify-audit-log [flags] <file>")
+		flags.PrintDefaults()
+	}
+	var after, last auditCheckpoint
+	flags.Var(&after, "after", "`<seq>:<hash>` of the entry before the first one, if the log was rotated")
+	flags.Var(&last, "last", "`<seq>:<hash>` that the last entry must have, to detect truncation")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var start *auditCheckpoint
+	if after.Hash != "" {
+		start = &after
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	defer f.Close()
+	n, end, err := verifyAuditLog(f, []byte(os.Getenv("AUDIT_LOG_HMAC_KEY")), start)
+	if err != nil {
+		log.Fatalf("Audit log is NOT intact: %v", err)
+	}
+	if last.Hash != "" {
+		if end == nil {
+			log.Fatalf("Audit log is NOT intact: it has no entries, expected last entry %v", last)
+		}
+		if *end != last {
+			log.Fatalf("Audit log is NOT intact: last entry is %v, expected %v", end, last)
+		}
+	}
+	if end == nil {
+		log.Infof("Audit log is intact, it has no entries")
+		return
+	}
+	log.Infof("Audit log is intact, %d entries verified, last entry is %v", n, end)
+}
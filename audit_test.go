@@ -0,0 +1,115 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authservice-audit")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	r := httptest.NewRequest("GET", "/login/oidc", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	audit, err := newAuditLogger(path, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error opening audit log: %+v", err)
+	}
+	audit.log(r, auditEvent{Type: auditSessionCreated, UserID: "alice", Session: "s1"})
+	audit.log(r, auditEvent{Type: auditLoginFailed, Reason: "state_mismatch"})
+	// Reopening the log continues the chain
+	audit, err = newAuditLogger(path, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening audit log: %+v", err)
+	}
+	audit.log(r, auditEvent{Type: auditSessionRevoked, UserID: "alice", Session: "s1", Reason: "logout"})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading audit log: %v", err)
+	}
+	n, last, err := verifyAuditLog(strings.NewReader(string(data)), nil, nil)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected intact log with 3 entries, got %d entries, %+v", n, err)
+	}
+	if last.Seq != 3 || last.Hash != audit.lastHash {
+		t.Errorf("Got last entry %v, want 3:%s", last, audit.lastHash)
+	}
+	if !strings.Contains(string(data), `"ip":"10.0.0.1"`) {
+		t.Fatalf("Audit log doesn't have the user's IP: %s", data)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	tampered := map[string]string{
+		"edited":       lines[0] + strings.Replace(lines[1], "state_mismatch", "nonce_mismatch", 1) + lines[2],
+		"deleted":      lines[0] + lines[2],
+		"swapped":      lines[0] + lines[2] + lines[1],
+		"head-deleted": lines[1] + lines[2],
+	}
+	for name, log := range tampered {
+		if _, _, err := verifyAuditLog(strings.NewReader(log), nil, nil); err == nil {
+			t.Errorf("Expected verification of %s log to fail", name)
+		}
+	}
+
+	// A rotated log continues from the last entry of the previous one
+	_, first, err := verifyAuditLog(strings.NewReader(lines[0]), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error verifying first entry: %+v", err)
+	}
+	if _, end, err := verifyAuditLog(strings.NewReader(lines[1]+lines[2]), nil, first); err != nil || *end != *last {
+		t.Errorf("Expected rotated log to end at %v, got %v, %+v", last, end, err)
+	}
+	if _, _, err := verifyAuditLog(strings.NewReader(lines[2]), nil, first); err == nil {
+		t.Error("Expected verification of rotated log without its first entry to fail")
+	}
+
+	// A truncated log is intact, but its last entry doesn't match the
+	// checkpoint
+	_, end, err := verifyAuditLog(strings.NewReader(lines[0]+lines[1]), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error verifying truncated log: %+v", err)
+	}
+	if *end == *last {
+		t.Errorf("Truncated log ends at the last entry %v", end)
+	}
+}
+
+func TestAuditLogHMAC(t *testing.T) {
+	var buf bytes.Buffer
+	audit := &auditLogger{w: &buf, key: []byte("secret")}
+	audit.log(nil, auditEvent{Type: auditSessionCreated, UserID: "alice"})
+	audit.log(nil, auditEvent{Type: auditSessionRevoked, UserID: "alice", Reason: "logout"})
+
+	if _, _, err := verifyAuditLog(bytes.NewReader(buf.Bytes()), []byte("secret"), nil); err != nil {
+		t.Fatalf("Unexpected error verifying log: %+v", err)
+	}
+	for _, key := range [][]byte{nil, []byte("other")} {
+		if _, _, err := verifyAuditLog(bytes.NewReader(buf.Bytes()), key, nil); err == nil {
+			t.Errorf("Log was verified with key %q", key)
+		}
+	}
+}
+
+func TestAuditCheckpoint(t *testing.T) {
+	c := auditCheckpoint{}
+	if err := c.Set("42:abcd"); err != nil || c.Seq != 42 || c.Hash != "abcd" {
+		t.Errorf("Got checkpoint %v, %v", c, err)
+	}
+	for _, invalid := range []string{"42", "abcd:42", "42:", "-1:abcd"} {
+		if err := c.Set(invalid); err == nil {
+			t.Errorf("Invalid checkpoint %q was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	authzDefaultAllow = "allow"
+	authzDefaultDeny  = "deny"
+)
+
+// authzConfig is the authorization policy, read from AUTHZ_CONFIG_PATH.
+//
+// Rules are evaluated in order and the first rule that matches the request
+// (by host, path and method) decides: the request is allowed only if all of
+// the rule's conditions on the user's claims hold. If no rule matches, the
+// default action is applied.
+type authzConfig struct {
+	// Default is the action for requests that don't match any rule,
+	// "allow" (default) or "deny".
+	Default string      `yaml:"default"`
+	Rules   []authzRule `yaml:"rules"`
+}
+
+type authzRule struct {
+	Name string `yaml:"name"`
+	// Hosts to match. A leading "*." matches any subdomain.
+	// Empty matches all hosts.
+	Hosts      []string `yaml:"hosts"`
+	PathPrefix string   `yaml:"pathPrefix"`
+	PathRegex  string   `yaml:"pathRegex"`
+	// Methods to match. Empty matches all methods.
+	Methods []string `yaml:"methods"`
+	// Require holds the conditions that must all hold for the request to be
+	// allowed.
+	Require []claimCondition `yaml:"require"`
+
+	pathRegex *regexp.Regexp
+}
+
+// claimCondition is a check on the value of a claim. Exactly one operator
+// must be set. For claims with multiple values (e.g. groups), the condition
+// holds if it holds for any of the values.
+type claimCondition struct {
+	Claim string `yaml:"claim"`
+	// Equals holds if the claim is equal to the given value.
+	Equals string `yaml:"equals"`
+	// OneOf holds if the claim is equal to any of the given values.
+	OneOf []string `yaml:"oneOf"`
+	// Contains holds if a list claim has the given element, or if a string
+	// claim has the given substring.
+	Contains string `yaml:"contains"`
+	Prefix   string `yaml:"prefix"`
+	Suffix   string `yaml:"suffix"`
+	Regex    string `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+// authorizer decides if an authenticated user may perform a request.
+type authorizer struct {
+	config authzConfig
+}
+
+func loadAuthorizer(path string) (*authorizer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading authorization config")
+	}
+	return newAuthorizer(data)
+}
+
+func newAuthorizer(data []byte) (*authorizer, error) {
+	config := authzConfig{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, errors.Wrap(err, "error parsing authorization config")
+	}
+	switch config.Default {
+	case "":
+		config.Default = authzDefaultAllow
+	case authzDefaultAllow, authzDefaultDeny:
+	default:
+		return nil, errors.Errorf("invalid default action %q, must be %q or %q",
+			config.Default, authzDefaultAllow, authzDefaultDeny)
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.PathRegex != "" {
+			re, err := regexp.Compile(rule.PathRegex)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid pathRegex in rule %s", rule.Name)
+			}
+			rule.pathRegex = re
+		}
+		for j := range rule.Require {
+			if err := rule.Require[j].compile(); err != nil {
+				return nil, errors.Wrapf(err, "invalid condition in rule %s", rule.Name)
+			}
+		}
+	}
+	return &authorizer{config: config}, nil
+}
+
+func (c *claimCondition) compile() error {
+	if c.Claim == "" {
+		return errors.New("condition doesn't specify a claim")
+	}
+	operators := 0
+	for _, set := range []bool{c.Equals != "", len(c.OneOf) > 0, c.Contains != "",
+		c.Prefix != "", c.Suffix != "", c.Regex != ""} {
+		if set {
+			operators++
+		}
+	}
+	if operators != 1 {
+		return errors.Errorf("condition on claim %q must have exactly one operator", c.Claim)
+	}
+	if c.Regex != "" {
+		re, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return err
+		}
+		c.regex = re
+	}
+	return nil
+}
+
+// authorize returns whether the user with the given claims may perform the
+// request, and the reason if not.
+func (a *authorizer) authorize(r *http.Request, claims map[string]interface{}) (bool, string) {
+	for _, rule := range a.config.Rules {
+		if !rule.matches(r) {
+			continue
+		}
+		for _, cond := range rule.Require {
+			if !cond.holds(claims[cond.Claim]) {
+				return false, fmt.Sprintf("rule %s: %s", rule.Name, cond)
+			}
+		}
+		return true, ""
+	}
+	if a.config.Default == authzDefaultDeny {
+		return false, "no rule matches the request"
+	}
+	return true, ""
+}
+
+func (rule *authzRule) matches(r *http.Request) bool {
+	if len(rule.Hosts) > 0 && !matchHost(rule.Hosts, r.Host) {
+		return false
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if rule.pathRegex != nil && !rule.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rule.Methods) > 0 {
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, r.Method) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchHost(hosts []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range hosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *claimCondition) holds(value interface{}) bool {
+	if list, ok := value.([]interface{}); ok {
+		if c.Contains != "" {
+			for _, v := range list {
+				if fmt.Sprint(v) == c.Contains {
+					return true
+				}
+			}
+			return false
+		}
+		for _, v := range list {
+			if c.holdsFor(fmt.Sprint(v)) {
+				return true
+			}
+		}
+		return false
+	}
+	if value == nil {
+		return false
+	}
+	return c.holdsFor(fmt.Sprint(value))
+}
+
+func (c *claimCondition) holdsFor(value string) bool {
+	switch {
+	case c.Equals != "":
+		return value == c.Equals
+	case len(c.OneOf) > 0:
+		for _, v := range c.OneOf {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	case c.Contains != "":
+		return strings.Contains(value, c.Contains)
+	case c.Prefix != "":
+		return strings.HasPrefix(value, c.Prefix)
+	case c.Suffix != "":
+		return strings.HasSuffix(value, c.Suffix)
+	case c.regex != nil:
+		return c.regex.MatchString(value)
+	}
+	return false
+}
+
+// String describes the condition that failed, for the 403 response.
+func (c claimCondition) String() string {
+	switch {
+	case c.Equals != "":
+		return fmt.Sprintf("claim %q must equal %q", c.Claim, c.Equals)
+	case len(c.OneOf) > 0:
+		return fmt.Sprintf("claim %q must be one of %q", c.Claim, c.OneOf)
+	case c.Contains != "":
+		return fmt.Sprintf("claim %q must contain %q", c.Claim, c.Contains)
+	case c.Prefix != "":
+		return fmt.Sprintf("claim %q must start with %q", c.Claim, c.Prefix)
+	case c.Suffix != "":
+		return fmt.Sprintf("claim %q must end with %q", c.Claim, c.Suffix)
+	default:
+		return fmt.Sprintf("claim %q must match %q", c.Claim, c.Regex)
+	}
+}
+
+// authorizeRequest checks the request against the authorization policy, if
+// one is configured. If the request is denied, it writes a 403 response with
+// the reason and returns false.
+func (s *server) authorizeRequest(w http.ResponseWriter, r *http.Request, claims map[string]interface{}) bool {
+	if s.authorizer == nil {
+		return true
+	}
+	allowed, reason := s.authorizer.authorize(r, claims)
+	if !allowed {
+		loggerForRequest(r).Infof("Request denied by authorization policy: %s", reason)
+		requestsTotal.WithLabelValues(outcomeDenied, "authorization_policy").Inc()
+		returnStatus(w, http.StatusForbidden, "Forbidden: "+reason)
+	}
+	return allowed
+}
@@ -0,0 +1,86 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+const testAuthzConfig = `
+rules:
+- name: admins
+  hosts: ["admin.example.com"]
+  require:
+  - claim: groups
+    contains: ml-admins
+- name: api-writes
+  pathRegex: ^/api/v[0-9]+/
+  methods: [POST, DELETE]
+  require:
+  - claim: email
+    suffix: "@corp.com"
+  - claim: email_verified
+    equals: "true"
+- name: public
+  pathPrefix: /public
+`
+
+func TestAuthorize(t *testing.T) {
+	authz, err := newAuthorizer([]byte(testAuthzConfig + "default: deny\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %+v", err)
+	}
+
+	admin := map[string]interface{}{
+		"email":          "admin@corp.com",
+		"email_verified": true,
+		"groups":         []interface{}{"users", "ml-admins"},
+	}
+	partner := map[string]interface{}{
+		"email":  "someone@partner.com",
+		"groups": []interface{}{"users"},
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		claims  map[string]interface{}
+		allowed bool
+	}{
+		{"admin host allowed", "GET", "https://admin.example.com:443/", admin, true},
+		{"admin host denied", "GET", "https://admin.example.com/", partner, false},
+		{"api write allowed", "POST", "https://example.com/api/v1/models", admin, true},
+		{"api write denied", "DELETE", "https://example.com/api/v1/models", partner, false},
+		{"public", "GET", "https://example.com/public/index.html", partner, true},
+		{"default deny", "GET", "https://example.com/api/v1/models", partner, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.url, nil)
+			allowed, reason := authz.authorize(r, test.claims)
+			if allowed != test.allowed {
+				t.Fatalf("Got allowed=%v (reason: %q), expected %v", allowed, reason, test.allowed)
+			}
+			if !allowed && reason == "" {
+				t.Fatal("Denied request without a reason")
+			}
+		})
+	}
+}
+
+func TestAuthorizerInvalidConfig(t *testing.T) {
+	configs := []string{
+		"default: maybe",
+		"rules:\n- require:\n  - claim: email\n",
+		"rules:\n- require:\n  - claim: email\n    equals: a\n    suffix: b\n",
+		"rules:\n- pathRegex: '('\n",
+		"rules:\n- unknownField: true\n",
+	}
+	for _, config := range configs {
+		if _, err := newAuthorizer([]byte(config)); err == nil {
+			t.Errorf("Expected error for config %q", config)
+		}
+	}
+}
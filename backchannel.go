@@ -0,0 +1,148 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// backchannelLogoutEvent is the event that identifies a logout token.
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutToken holds the claims of a verified logout token.
+type logoutToken struct {
+	// provider is the provider that issued the token.
+	provider *oidcProvider
+	Subject  string
+	SID      string
+}
+
+// verifyLogoutToken verifies a logout token against the keys of the provider
+// that issued it and validates its claims, as described in:
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+func (s *server) verifyLogoutToken(ctx context.Context, rawToken string) (*logoutToken, error) {
+	issuer, err := unverifiedIssuer(rawToken)
+	if err != nil {
+		return nil, err
+	}
+	p := providerByIssuer(s.providers, issuer)
+	if p == nil {
+		return nil, errors.Errorf("logout token from unknown issuer %q", issuer)
+	}
+	verifyCtx, span := startSpan(ctx, "oidc.VerifyToken")
+	token, err := p.verifier().Verify(verifyCtx, rawToken)
+	endSpan(span, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "error verifying logout token")
+	}
+	claims := struct {
+		SID    string                     `json:"sid"`
+		Events map[string]json.RawMessage `json:"events"`
+	}{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, errors.Wrap(err, "error parsing logout token claims")
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return nil, errors.New("logout token doesn't have a back-channel logout event")
+	}
+	// A nonce means this is an ID token, which must not be accepted as a
+	// logout token.
+	if token.Nonce != "" {
+		return nil, errors.New("logout token must not have a nonce")
+	}
+	if token.Subject == "" && claims.SID == "" {
+		return nil, errors.New("logout token must have a sub or sid claim")
+	}
+	return &logoutToken{provider: p, Subject: token.Subject, SID: claims.SID}, nil
+}
+
+// sessionsForLogoutToken returns the sessions that a logout token refers to.
+// If the token has a sid, only that IdP session is logged out. Otherwise, all
+// the sessions of the subject are. Only sessions issued by the token's
+// provider are returned, as subjects and sids are only unique per provider.
+func (s *server) sessionsForLogoutToken(t *logoutToken) ([]*sessionRecord, error) {
+	var recs []*sessionRecord
+	var err error
+	if t.SID == "" {
+		recs, err = s.backend.ListBySubject(t.Subject)
+	} else {
+		recs, err = s.backend.ListBySID(t.SID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := []*sessionRecord{}
+	for _, rec := range recs {
+		if s.recordProvider(rec) != t.provider {
+			continue
+		}
+		if t.Subject == "" || rec.Subject == t.Subject {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// deleteSessions deletes the given user sessions from the store and returns
+// how many were deleted. The reason is recorded in the audit log.
+func (s *server) deleteSessions(r *http.Request, recs []*sessionRecord, reason string) (int, error) {
+	n := 0
+	for _, rec := range recs {
+		if rec.Kind != recordKindSession {
+			continue
+		}
+		if err := s.backend.Delete(rec.ID); err != nil {
+			return n, err
+		}
+		s.audit.log(r, recordAuditEvent(auditSessionRevoked, rec, reason))
+		n++
+	}
+	return n, nil
+}
+
+// backchannelLogout is the handler for logout requests sent by the IdP
+// directly to the authservice, e.g. when a user logs out centrally or is
+// disabled. It deletes the user's sessions, so that they can't be used until
+// they expire.
+// See: https://openid.net/specs/openid-connect-backchannel-1_0.html
+func (s *server) backchannelLogout(w http.ResponseWriter, r *http.Request) {
+
+	logger := loggerForRequest(r)
+	w.Header().Set("Cache-Control", "no-store")
+
+	rawToken := r.PostFormValue("logout_token")
+	if rawToken == "" {
+		logger.Error("Missing form parameter: logout_token")
+		returnStatus(w, http.StatusBadRequest, "Missing form parameter: logout_token")
+		return
+	}
+
+	ctx := setTLSContext(r.Context(), s.caBundle)
+	token, err := s.verifyLogoutToken(ctx, rawToken)
+	if err != nil {
+		logger.Errorf("Invalid logout token: %v", err)
+		returnStatus(w, http.StatusBadRequest, "Invalid logout token.")
+		return
+	}
+	logger = logger.WithFields(log.Fields{"sub": token.Subject, "sid": token.SID})
+
+	recs, err := s.sessionsForLogoutToken(token)
+	if err != nil {
+		logger.Errorf("Couldn't find sessions for back-channel logout: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Couldn't find sessions.")
+		return
+	}
+	n, err := s.deleteSessions(r, recs, "backchannel_logout")
+	if err != nil {
+		logger.Errorf("Couldn't delete user session: %v", err)
+		returnStatus(w, http.StatusInternalServerError, "Couldn't delete user session.")
+		return
+	}
+	logger.Infof("Back-channel logout deleted %d sessions", n)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,187 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testProvider is a fake OIDC provider that serves a discovery document and
+// the keys of its signer. Its token and UserInfo endpoints return the
+// responses set by the test.
+type testProvider struct {
+	*httptest.Server
+	key           *rsa.PrivateKey
+	tokenResponse map[string]interface{}
+	userInfo      map[string]interface{}
+	// tokenStatus, if set, is the status of token endpoint responses
+	tokenStatus int
+	// tokenRequests records the forms posted to the token endpoint
+	tokenRequests []url.Values
+	// pkceMethods are the code_challenge_methods_supported of the
+	// discovery document
+	pkceMethods []string
+	// endSessionEndpoint, if set, is the end_session_endpoint of the
+	// discovery document
+	endSessionEndpoint string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+	p := &testProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                           p.URL,
+			"authorization_endpoint":           p.URL + "/auth",
+			"token_endpoint":                   p.URL + "/token",
+			"jwks_uri":                         p.URL + "/keys",
+			"userinfo_endpoint":                p.URL + "/userinfo",
+			"code_challenge_methods_supported": p.pkceMethods,
+			"end_session_endpoint":             p.endSessionEndpoint,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.tokenRequests = append(p.tokenRequests, r.PostForm)
+		w.Header().Set("Content-Type", "application/json")
+		if p.tokenStatus != 0 {
+			w.WriteHeader(p.tokenStatus)
+		}
+		json.NewEncoder(w).Encode(p.tokenResponse)
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.userInfo)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// provider returns the fake provider as an oidcProvider with the given name,
+// for the "authservice" client.
+func (p *testProvider) provider(t *testing.T, name string) *oidcProvider {
+	provider, err := newOIDCProvider(context.Background(), providerConfig{
+		Name:     name,
+		Issuer:   p.URL,
+		ClientID: "authservice",
+	}, pkceModeDisabled)
+	if err != nil {
+		t.Fatalf("Unexpected error creating provider: %v", err)
+	}
+	return provider
+}
+
+// sign returns a JWT with the given claims, signed by the provider.
+func (p *testProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: p.key, KeyID: "test"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating signer: %v", err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatalf("Unexpected error signing token: %v", err)
+	}
+	return token
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	idp := newTestProvider(t)
+	backend := newMemoryStore()
+	s := &server{
+		providers: []*oidcProvider{idp.provider(t, defaultProviderName)},
+		backend:   backend,
+	}
+
+	sessions := []*sessionRecord{
+		{ID: "alice-1", Kind: recordKindSession, Subject: "alice", SID: "sid-1"},
+		{ID: "alice-2", Kind: recordKindSession, Subject: "alice", SID: "sid-2"},
+		{ID: "bob", Kind: recordKindSession, Subject: "bob", SID: "sid-3"},
+	}
+	for _, rec := range sessions {
+		if err := backend.Put(rec, time.Minute); err != nil {
+			t.Fatalf("Unexpected error in Put: %+v", err)
+		}
+	}
+
+	logoutClaims := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":    idp.URL,
+			"aud":    "authservice",
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(time.Minute).Unix(),
+			"jti":    newRecordID(),
+			"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+	tests := []struct {
+		name      string
+		token     string
+		status    int
+		remaining []string
+	}{
+		{"missing token", "", http.StatusBadRequest, []string{"alice-1", "alice-2", "bob"}},
+		{"wrong audience", idp.sign(t, logoutClaims(map[string]interface{}{"sub": "alice", "aud": "other"})),
+			http.StatusBadRequest, []string{"alice-1", "alice-2", "bob"}},
+		{"no event", idp.sign(t, logoutClaims(map[string]interface{}{"sub": "alice", "events": nil})),
+			http.StatusBadRequest, []string{"alice-1", "alice-2", "bob"}},
+		{"id token", idp.sign(t, logoutClaims(map[string]interface{}{"sub": "alice", "nonce": "foo"})),
+			http.StatusBadRequest, []string{"alice-1", "alice-2", "bob"}},
+		{"by sid", idp.sign(t, logoutClaims(map[string]interface{}{"sub": "alice", "sid": "sid-1"})),
+			http.StatusOK, []string{"alice-2", "bob"}},
+		{"by sub", idp.sign(t, logoutClaims(map[string]interface{}{"sub": "alice"})),
+			http.StatusOK, []string{"bob"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{}
+			if test.token != "" {
+				form.Set("logout_token", test.token)
+			}
+			r := httptest.NewRequest("POST", "/logout/backchannel", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			s.backchannelLogout(w, r)
+			if w.Code != test.status {
+				t.Fatalf("Wrong status. Got %d, expected %d: %s", w.Code, test.status, w.Body.String())
+			}
+			remaining := []string{}
+			for _, rec := range sessions {
+				if _, err := backend.Get(rec.ID); err == nil {
+					remaining = append(remaining, rec.ID)
+				}
+			}
+			if strings.Join(remaining, ",") != strings.Join(test.remaining, ",") {
+				t.Fatalf("Wrong remaining sessions. Got %v, expected %v", remaining, test.remaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+var errUntrustedIssuer = errors.New("untrusted issuer")
+
+// trustedIssuersConfig is the list of issuers whose tokens are accepted as
+// bearer tokens, read from TRUSTED_ISSUERS_CONFIG_PATH.
+type trustedIssuersConfig struct {
+	Issuers []trustedIssuerConfig `yaml:"issuers"`
+}
+
+type trustedIssuerConfig struct {
+	Issuer string `yaml:"issuer"`
+	// Audiences are the accepted values of the aud claim. A token is
+	// accepted if any of its audiences is in the list.
+	Audiences []string `yaml:"audiences"`
+	// AuthorizedParties, if set, are the only clients whose tokens are
+	// accepted, checked against the azp claim.
+	AuthorizedParties []string `yaml:"authorizedParties"`
+	UserIDClaim       string   `yaml:"userIDClaim"`
+}
+
+func loadTrustedIssuersConfig(path string) ([]trustedIssuerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading trusted issuers config")
+	}
+	return parseTrustedIssuersConfig(data)
+}
+
+func parseTrustedIssuersConfig(data []byte) ([]trustedIssuerConfig, error) {
+	config := trustedIssuersConfig{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, errors.Wrap(err, "error parsing trusted issuers config")
+	}
+	issuers := map[string]bool{}
+	for _, c := range config.Issuers {
+		if c.Issuer == "" {
+			return nil, errors.New("trusted issuer doesn't have an issuer URL")
+		}
+		if issuers[c.Issuer] {
+			return nil, errors.Errorf("duplicate trusted issuer %q", c.Issuer)
+		}
+		issuers[c.Issuer] = true
+		if len(c.Audiences) == 0 {
+			return nil, errors.Errorf("trusted issuer %q must have at least one audience", c.Issuer)
+		}
+	}
+	return config.Issuers, nil
+}
+
+// bearerIssuer verifies the bearer tokens of an issuer.
+type bearerIssuer struct {
+	issuer            string
+	audiences         []string
+	authorizedParties []string
+	userIDClaim       string
+	verifier          *oidc.IDTokenVerifier
+}
+
+// newBearerIssuer returns a bearerIssuer for the given provider. The verifier
+// skips the audience check of go-oidc, which only supports one audience, and
+// verify checks the audiences instead.
+func newBearerIssuer(provider *oidc.Provider, c trustedIssuerConfig) *bearerIssuer {
+	return &bearerIssuer{
+		issuer:            c.Issuer,
+		audiences:         c.Audiences,
+		authorizedParties: c.AuthorizedParties,
+		userIDClaim:       c.UserIDClaim,
+		verifier:          provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+	}
+}
+
+// verify verifies the token's signature and expiry, and checks that it was
+// issued to an accepted audience and authorized party.
+// If the token has no azp claim and a single audience, the audience is the
+// authorized party.
+func (b *bearerIssuer) verify(ctx context.Context, rawToken string) (*oidc.IDToken, error) {
+	token, err := b.verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if !containsAnyString(b.audiences, token.Audience) {
+		return nil, errors.Errorf("token audience %v is not accepted", token.Audience)
+	}
+	if len(b.authorizedParties) > 0 {
+		claims := struct {
+			AZP string `json:"azp"`
+		}{}
+		if err := token.Claims(&claims); err != nil {
+			return nil, errors.Wrap(err, "error parsing token claims")
+		}
+		azp := claims.AZP
+		if azp == "" && len(token.Audience) == 1 {
+			azp = token.Audience[0]
+		}
+		if !containsAnyString(b.authorizedParties, []string{azp}) {
+			return nil, errors.Errorf("token authorized party %q is not accepted", azp)
+		}
+	}
+	return token, nil
+}
+
+// bearerIssuers caches the verifiers of the trusted issuers. Issuers are
+// discovered on first use, so that an unreachable issuer doesn't delay
+// startup or break the other issuers.
+type bearerIssuers struct {
+	// ctx is used for discovery. It must outlive requests, as verifiers
+	// fetch the issuer's keys with it.
+	ctx     context.Context
+	configs map[string]trustedIssuerConfig
+
+	mu      sync.Mutex
+	issuers map[string]*bearerIssuer
+}
+
+func newBearerIssuers(ctx context.Context, configs []trustedIssuerConfig) *bearerIssuers {
+	b := &bearerIssuers{
+		ctx:     ctx,
+		configs: map[string]trustedIssuerConfig{},
+		issuers: map[string]*bearerIssuer{},
+	}
+	for _, c := range configs {
+		b.configs[c.Issuer] = c
+	}
+	return b
+}
+
+// get returns the bearerIssuer of a trusted issuer, or nil if the issuer is
+// not trusted. Failed discoveries are not cached, they are retried on the
+// next request.
+func (b *bearerIssuers) get(ctx context.Context, issuer string) (*bearerIssuer, error) {
+	if b == nil {
+		return nil, nil
+	}
+	c, ok := b.configs[issuer]
+	if !ok {
+		return nil, nil
+	}
+	b.mu.Lock()
+	bi := b.issuers[issuer]
+	b.mu.Unlock()
+	if bi != nil {
+		return bi, nil
+	}
+
+	_, span := startSpan(ctx, "oidc.Discovery")
+	provider, err := oidc.NewProvider(b.ctx, issuer)
+	endSpan(span, err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error discovering trusted issuer %q", issuer)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Another request may have discovered the issuer in the meantime
+	if b.issuers[issuer] == nil {
+		b.issuers[issuer] = newBearerIssuer(provider, c)
+	}
+	return b.issuers[issuer], nil
+}
+
+// bearerIssuerFor returns the issuer that verifies a JWT bearer token, picked
+// by the token's iss claim from the trusted issuers and the given login
+// providers.
+func (s *server) bearerIssuerFor(ctx context.Context, providers []*oidcProvider, rawToken string) (*bearerIssuer, error) {
+	issuer, err := unverifiedIssuer(rawToken)
+	if err != nil {
+		return nil, err
+	}
+	bi, err := s.bearerIssuers.get(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if bi == nil {
+		if p := providerByIssuer(providers, issuer); p != nil {
+			bi = p.bearer
+		}
+	}
+	if bi == nil {
+		return nil, errors.Wrapf(errUntrustedIssuer, "issuer %q", issuer)
+	}
+	return bi, nil
+}
+
+// verifyBearerToken verifies a bearer token and returns the issuer that
+// verified it. Tokens are accepted from the trusted issuers, and from the
+// given login providers for their client ID.
+func (s *server) verifyBearerToken(ctx context.Context, providers []*oidcProvider, rawToken string) (*bearerIssuer, *oidc.IDToken, error) {
+	// Access tokens must not be accepted as ID tokens, see:
+	// https://tools.ietf.org/html/rfc9068#section-4
+	if isAccessTokenJWT(rawToken) {
+		return nil, nil, errors.New("token is an access token, not an ID token")
+	}
+	bi, err := s.bearerIssuerFor(ctx, providers, rawToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifyCtx, span := startSpan(ctx, "oidc.VerifyToken")
+	token, err := bi.verify(verifyCtx, rawToken)
+	endSpan(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bi, token, nil
+}
+
+// jwtBearerClaims verifies a JWT bearer token and returns its claims and the
+// claim with the userid. If the token is rejected, it writes the response and
+// returns false.
+func (s *server) jwtBearerClaims(w http.ResponseWriter, r *http.Request, providers []*oidcProvider, rawToken string) (map[string]interface{}, string, bool) {
+	logger := loggerForRequest(r)
+
+	// Ensure the token is issued by a trusted issuer, or to us by one of
+	// the providers of this request
+	issuer, idToken, err := s.verifyBearerToken(r.Context(), providers, rawToken)
+	if err != nil {
+		logger.Errorf("Not able to verify ID token: %v", err)
+		reason := "invalid_token"
+		if errors.Cause(err) == errUntrustedIssuer {
+			reason = "untrusted_issuer"
+		}
+		s.bearerRejected(r, reason)
+		requestsTotal.WithLabelValues(outcomeUnauthenticated, "invalid_bearer_token").Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		returnStatus(w, http.StatusUnauthorized, "Unable to verify ID token.")
+		return nil, "", false
+	}
+
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		logger.Println("Problem getting userinfo claims:", err.Error())
+		s.bearerRejected(r, "invalid_claims")
+		requestsTotal.WithLabelValues(outcomeError, "invalid_bearer_claims").Inc()
+		returnStatus(w, http.StatusInternalServerError, "Not able to fetch userinfo claims.")
+		return nil, "", false
+	}
+	return claims, issuer.userIDClaim, true
+}
+
+func containsAnyString(list, values []string) bool {
+	for _, v := range values {
+		for _, item := range list {
+			if v == item {
+				return true
+			}
+		}
+	}
+	return false
+}
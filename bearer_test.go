@@ -0,0 +1,162 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseTrustedIssuersConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"valid", "issuers:\n- issuer: https://a\n  audiences: [authservice, cli]\n  authorizedParties: [cli]\n", false},
+		{"empty", "issuers: []\n", false},
+		{"missing issuer", "issuers:\n- audiences: [cli]\n", true},
+		{"missing audiences", "issuers:\n- issuer: https://a\n", true},
+		{"duplicate issuer", "issuers:\n- {issuer: https://a, audiences: [a]}\n- {issuer: https://a, audiences: [b]}\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTrustedIssuersConfig([]byte(test.config))
+			if (err != nil) != test.err {
+				t.Errorf("Got error %v, want error: %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyBearerToken(t *testing.T) {
+	login := newTestProvider(t)
+	trusted := newTestProvider(t)
+	untrusted := newTestProvider(t)
+	s := &server{
+		providers: []*oidcProvider{login.provider(t, defaultProviderName)},
+		bearerIssuers: newBearerIssuers(context.Background(), []trustedIssuerConfig{{
+			Issuer:            trusted.URL,
+			Audiences:         []string{"authservice", "cli"},
+			AuthorizedParties: []string{"cli"},
+			UserIDClaim:       "sub",
+		}}),
+	}
+
+	token := func(idp *testProvider, extra map[string]interface{}) string {
+		claims := map[string]interface{}{
+			"iss": idp.URL,
+			"sub": "alice",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return idp.sign(t, claims)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		issuer string
+		err    bool
+	}{
+		{"login provider", token(login, map[string]interface{}{"aud": "authservice"}), login.URL, false},
+		{"login provider other audience", token(login, map[string]interface{}{"aud": "cli"}), "", true},
+		{"trusted azp", token(trusted, map[string]interface{}{"aud": []string{"authservice", "cli"}, "azp": "cli"}), trusted.URL, false},
+		{"trusted single audience", token(trusted, map[string]interface{}{"aud": "cli"}), trusted.URL, false},
+		{"trusted other azp", token(trusted, map[string]interface{}{"aud": "authservice", "azp": "web"}), "", true},
+		{"trusted no azp", token(trusted, map[string]interface{}{"aud": "authservice"}), "", true},
+		{"trusted other audience", token(trusted, map[string]interface{}{"aud": "other", "azp": "cli"}), "", true},
+		{"trusted expired", token(trusted, map[string]interface{}{"aud": "cli", "exp": time.Now().Add(-time.Minute).Unix()}), "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer, _, err := s.verifyBearerToken(context.Background(), s.providers, test.token)
+			if (err != nil) != test.err {
+				t.Fatalf("Got error %v, want error: %v", err, test.err)
+			}
+			if err == nil && issuer.issuer != test.issuer {
+				t.Errorf("Token verified by %q, want %q", issuer.issuer, test.issuer)
+			}
+		})
+	}
+
+	// Tokens of login providers are only accepted for their requests
+	_, _, err := s.verifyBearerToken(context.Background(), nil, token(login, map[string]interface{}{"aud": "authservice"}))
+	if errors.Cause(err) != errUntrustedIssuer {
+		t.Errorf("Got error %v for provider that doesn't serve the request, want %v", err, errUntrustedIssuer)
+	}
+	_, _, err = s.verifyBearerToken(context.Background(), s.providers, token(untrusted, map[string]interface{}{"aud": "cli"}))
+	if errors.Cause(err) != errUntrustedIssuer {
+		t.Errorf("Got error %v for untrusted issuer, want %v", err, errUntrustedIssuer)
+	}
+
+	// Verifiers are discovered once and cached
+	first, err := s.bearerIssuers.get(context.Background(), trusted.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	trusted.Close()
+	second, err := s.bearerIssuers.get(context.Background(), trusted.URL)
+	if err != nil || first != second {
+		t.Errorf("Trusted issuer was not cached: %v", err)
+	}
+}
+
+func TestInvalidBearerToken(t *testing.T) {
+	idp := newTestProvider(t)
+	untrusted := newTestProvider(t)
+	s := &server{
+		providers:     []*oidcProvider{idp.provider(t, defaultProviderName)},
+		bearerIssuers: newBearerIssuers(context.Background(), nil),
+		userIDOpts:    userIDOpts{header: "kubeflow-userid"},
+	}
+
+	token := func(idp *testProvider, extra map[string]interface{}) string {
+		claims := map[string]interface{}{
+			"iss": idp.URL,
+			"aud": "authservice",
+			"sub": "alice",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return idp.sign(t, claims)
+	}
+	valid := token(idp, nil)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other audience", token(idp, map[string]interface{}{"aud": "other"})},
+		{"expired", token(idp, map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})},
+		{"untrusted issuer", token(untrusted, nil)},
+		{"bad signature", valid[:len(valid)-4] + "AAAA"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+			s.authenticate(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Got status %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body.String())
+			}
+			want := `Bearer error="invalid_token"`
+			if got := w.Header().Get("WWW-Authenticate"); got != want {
+				t.Errorf("Got WWW-Authenticate header %q, want %q", got, want)
+			}
+			if got := w.Header().Get("kubeflow-userid"); got != "" {
+				t.Errorf("Got userid header %q for invalid token", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var boltBucketName = []byte("authservice_sessions")
+
+// legacyBoltBucketName is the bucket of the sessions of the gorilla store
+// that we used before. Its sessions can't be converted, as they lack most of
+// the fields of a sessionRecord, so they are deleted on open.
+var legacyBoltBucketName = []byte("sessions")
+
+// boltStore is a sessionStore that keeps records in a local BoltDB file.
+// BoltDB locks the file, so it can only be used by a single replica.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening bolt store")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(legacyBoltBucketName) != nil {
+			log.Warn("Deleting sessions of the old bolt store format, users must log in again")
+			if err := tx.DeleteBucket(legacyBoltBucketName); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucketIfNotExists(boltBucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error creating bolt bucket")
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(id string) (*sessionRecord, error) {
+	var rec *sessionRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltBucketName).Get([]byte(id))
+		if data == nil {
+			return errRecordNotFound
+		}
+		var err error
+		rec, err = decodeRecord(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(rec.ExpiresAt) {
+		return nil, errRecordNotFound
+	}
+	return rec, nil
+}
+
+func (s *boltStore) Put(rec *sessionRecord, ttl time.Duration) error {
+	rec.ExpiresAt = time.Now().Add(ttl)
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Put([]byte(rec.ID), data)
+	})
+	return errors.Wrap(err, "error writing record to bolt store")
+}
+
+func (s *boltStore) Delete(id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Delete([]byte(id))
+	})
+	return errors.Wrap(err, "error deleting record from bolt store")
+}
+
+func (s *boltStore) List() ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return true })
+}
+
+func (s *boltStore) ListByUser(userID string) ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return rec.UserID == userID })
+}
+
+func (s *boltStore) ListBySubject(sub string) ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return rec.Subject == sub })
+}
+
+func (s *boltStore) ListBySID(sid string) ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return rec.SID == sid })
+}
+
+// list returns all unexpired records for which match returns true.
+// It scans the whole bucket, as BoltDB has no secondary indexes.
+func (s *boltStore) list(match func(*sessionRecord) bool) ([]*sessionRecord, error) {
+	now := time.Now()
+	res := []*sessionRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).ForEach(func(k, v []byte) error {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if match(rec) && now.Before(rec.ExpiresAt) {
+				res = append(res, rec)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) sweep() (int, error) {
+	now := time.Now()
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketName)
+		expired := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			rec, err := decodeRecord(v)
+			if err != nil || !now.Before(rec.ExpiresAt) {
+				// Also remove records we can't decode, they are useless
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys can't be deleted while iterating with ForEach
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting expired records from bolt store")
+	}
+	return n, nil
+}
@@ -0,0 +1,213 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// authResultKey is the context key under which callers of authenticate can
+// ask for the identity of the authenticated user.
+type authResultKey struct{}
+
+// authResult is filled in by authenticate when a request is allowed.
+type authResult struct {
+	userID string
+	claims map[string]interface{}
+}
+
+// withAuthResult returns a context in which authenticate will record the
+// user's identity, and the authResult it will be recorded in.
+func withAuthResult(ctx context.Context) (context.Context, *authResult) {
+	res := &authResult{}
+	return context.WithValue(ctx, authResultKey{}, res), res
+}
+
+// setAuthResult records the identity of the user, if the caller asked for it.
+func setAuthResult(r *http.Request, userID string, claims map[string]interface{}) {
+	if res, ok := r.Context().Value(authResultKey{}).(*authResult); ok {
+		res.userID = userID
+		res.claims = claims
+	}
+}
+
+// extAuthzServer implements Envoy's ext_authz gRPC service.
+// Each Check request is converted to an HTTP request and passed to the same
+// handler that serves HTTP ext_authz requests, so both modes make the same
+// decisions.
+// See: https://www.envoyproxy.io/docs/envoy/latest/api-v3/service/auth/v3/external_auth.proto
+type extAuthzServer struct {
+	handler http.Handler
+}
+
+var _ authv3.AuthorizationServer = &extAuthzServer{}
+
+func newExtAuthzGRPCServer(handler http.Handler) *grpc.Server {
+	srv := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(srv, &extAuthzServer{handler: handler})
+	return srv
+}
+
+// Check implements the ext_authz Authorization service.
+func (e *extAuthzServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	ctx, result := withAuthResult(ctx)
+	r, err := checkRequestToHTTP(ctx, req)
+	if err != nil {
+		log.Errorf("Invalid ext_authz check request: %v", err)
+		return nil, err
+	}
+
+	w := newHeaderRecorder()
+	e.handler.ServeHTTP(w, r)
+
+	if w.code == http.StatusOK {
+		resp := &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: okResponseFromHeaders(w.header),
+			},
+		}
+		if result.claims != nil {
+			metadata, err := structpb.NewStruct(map[string]interface{}{
+				"userid": result.userID,
+				"claims": result.claims,
+			})
+			if err != nil {
+				log.Warnf("Couldn't convert claims to dynamic metadata: %v", err)
+			} else {
+				resp.DynamicMetadata = metadata
+			}
+		}
+		return resp, nil
+	}
+
+	code := codes.PermissionDenied
+	switch {
+	case w.code == http.StatusUnauthorized || (w.code >= 300 && w.code < 400):
+		code = codes.Unauthenticated
+	case w.code >= 500:
+		code = codes.Unavailable
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(w.code)},
+				Headers: headerValueOptions(w.header, corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD),
+				Body:    w.body.String(),
+			},
+		},
+	}, nil
+}
+
+// checkRequestToHTTP builds the HTTP request that Envoy would have sent to the
+// authservice in HTTP ext_authz mode.
+func checkRequestToHTTP(ctx context.Context, req *authv3.CheckRequest) (*http.Request, error) {
+	attrs := req.GetAttributes().GetRequest().GetHttp()
+	if attrs == nil {
+		return nil, errors.New("check request has no HTTP attributes")
+	}
+	path := attrs.GetPath()
+	if path == "" {
+		path = "/"
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid path %q", path)
+	}
+	r := (&http.Request{
+		Method:     attrs.GetMethod(),
+		URL:        u,
+		RequestURI: path,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       attrs.GetHost(),
+		Body:       http.NoBody,
+	}).WithContext(ctx)
+	for k, v := range attrs.GetHeaders() {
+		// Pseudo-headers are already part of the request
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	if sock := req.GetAttributes().GetSource().GetAddress().GetSocketAddress(); sock != nil {
+		r.RemoteAddr = net.JoinHostPort(sock.GetAddress(), "0")
+	}
+	return r, nil
+}
+
+// okResponseFromHeaders splits the headers set by the handler into headers
+// for the upstream request and headers for the response to the client.
+func okResponseFromHeaders(h http.Header) *authv3.OkHttpResponse {
+	upstream := http.Header{}
+	client := http.Header{}
+	for k, v := range h {
+		if k == "Set-Cookie" {
+			client[k] = v
+		} else {
+			upstream[k] = v
+		}
+	}
+	return &authv3.OkHttpResponse{
+		// Identity headers must replace any value sent by the client
+		Headers:              headerValueOptions(upstream, corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD),
+		ResponseHeadersToAdd: headerValueOptions(client, corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD),
+	}
+}
+
+func headerValueOptions(h http.Header, action corev3.HeaderValueOption_HeaderAppendAction) []*corev3.HeaderValueOption {
+	res := []*corev3.HeaderValueOption{}
+	for k, values := range h {
+		if k == "Content-Type" || k == "Content-Length" {
+			continue
+		}
+		for _, v := range values {
+			res = append(res, &corev3.HeaderValueOption{
+				Header:       &corev3.HeaderValue{Key: k, Value: v},
+				AppendAction: action,
+			})
+		}
+	}
+	return res
+}
+
+// headerRecorder is a minimal http.ResponseWriter that records the response
+// of a handler.
+type headerRecorder struct {
+	code   int
+	header http.Header
+	body   strings.Builder
+}
+
+func newHeaderRecorder() *headerRecorder {
+	return &headerRecorder{code: http.StatusOK, header: http.Header{}}
+}
+
+func (h *headerRecorder) Header() http.Header {
+	return h.header
+}
+
+func (h *headerRecorder) Write(b []byte) (int, error) {
+	return h.body.Write(b)
+}
+
+func (h *headerRecorder) WriteHeader(code int) {
+	h.code = code
+}
@@ -0,0 +1,107 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+)
+
+func newCheckRequest(path string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+					SocketAddress: &corev3.SocketAddress{Address: "10.0.0.1"},
+				}},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  http.MethodGet,
+					Host:    "example.com",
+					Path:    path,
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func findHeader(opts []*corev3.HeaderValueOption, key string) string {
+	for _, opt := range opts {
+		if opt.GetHeader().GetKey() == key {
+			return opt.GetHeader().GetValue()
+		}
+	}
+	return ""
+}
+
+func TestExtAuthzCheck(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") == "" {
+			http.Redirect(w, r, "https://idp.example.com/auth", http.StatusFound)
+			return
+		}
+		if r.URL.Path != "/app" || r.URL.Query().Get("q") != "1" || r.Host != "example.com" {
+			t.Errorf("Wrong request: %v %v", r.Host, r.URL)
+		}
+		if getUserIP(r) != "10.0.0.1" {
+			t.Errorf("Wrong user IP: %v", getUserIP(r))
+		}
+		w.Header().Set("kubeflow-userid", "user@example.com")
+		w.Header().Add("Set-Cookie", "refreshed=1")
+		setAuthResult(r, "user@example.com", map[string]interface{}{
+			"email":  "user@example.com",
+			"groups": []interface{}{"admins"},
+		})
+		returnStatus(w, http.StatusOK, "OK")
+	})
+	e := &extAuthzServer{handler: handler}
+
+	// Logged in user
+	resp, err := e.Check(context.Background(), newCheckRequest("/app?q=1", map[string]string{
+		":path":  "/app?q=1",
+		"cookie": "authservice_session=foo",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if codes.Code(resp.GetStatus().GetCode()) != codes.OK {
+		t.Fatalf("Wrong status: %v", resp.GetStatus())
+	}
+	ok := resp.GetOkResponse()
+	if got := findHeader(ok.GetHeaders(), "Kubeflow-Userid"); got != "user@example.com" {
+		t.Fatalf("Wrong userid header: %q", got)
+	}
+	if got := findHeader(ok.GetResponseHeadersToAdd(), "Set-Cookie"); got != "refreshed=1" {
+		t.Fatalf("Wrong Set-Cookie response header: %q", got)
+	}
+	if findHeader(ok.GetHeaders(), "Set-Cookie") != "" {
+		t.Fatal("Set-Cookie must not be sent upstream")
+	}
+	metadata := resp.GetDynamicMetadata().AsMap()
+	if metadata["userid"] != "user@example.com" {
+		t.Fatalf("Wrong dynamic metadata: %v", metadata)
+	}
+
+	// Anonymous user
+	resp, err = e.Check(context.Background(), newCheckRequest("/app", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if codes.Code(resp.GetStatus().GetCode()) != codes.Unauthenticated {
+		t.Fatalf("Wrong status: %v", resp.GetStatus())
+	}
+	denied := resp.GetDeniedResponse()
+	if denied.GetStatus().GetCode() != http.StatusFound {
+		t.Fatalf("Wrong HTTP status: %v", denied.GetStatus())
+	}
+	if got := findHeader(denied.GetHeaders(), "Location"); got != "https://idp.example.com/auth" {
+		t.Fatalf("Wrong Location header: %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// frontchannelLogoutPage is returned to the IdP's iframe. It has no content,
+// the IdP only waits for it to load.
+const frontchannelLogoutPage = `<!DOCTYPE html><html><head><title>Logged out</title></head><body></body></html>`
+
+// frontchannelLogout is the handler for logout requests that the IdP sends
+// through the user's browser, by rendering it in an iframe. Sessions are
+// deleted without revoking their tokens, as the IdP has already ended the
+// user's session.
+// If the IdP sends the iss and sid parameters, all sessions of that IdP
+// session are deleted. Otherwise, the session of the browser is deleted.
+// See: https://openid.net/specs/openid-connect-frontchannel-1_0.html
+func (s *server) frontchannelLogout(w http.ResponseWriter, r *http.Request) {
+
+	logger := loggerForRequest(r)
+
+	iss := r.URL.Query().Get("iss")
+	sid := r.URL.Query().Get("sid")
+	p := providerByIssuer(s.providers, iss)
+	switch {
+	case iss != "" && p == nil:
+		logger.Errorf("Front-channel logout for unknown issuer %q", iss)
+		returnStatus(w, http.StatusBadRequest, "Unknown issuer.")
+		return
+	case sid != "" && iss == "":
+		logger.Error("Front-channel logout with a sid but no iss")
+		returnStatus(w, http.StatusBadRequest, "Missing url parameter: iss")
+		return
+	case sid != "":
+		recs, err := s.sessionsForLogoutToken(&logoutToken{provider: p, SID: sid})
+		if err != nil {
+			logger.Errorf("Couldn't find sessions for front-channel logout: %v", err)
+			returnStatus(w, http.StatusInternalServerError, "Couldn't find sessions.")
+			return
+		}
+		n, err := s.deleteSessions(r, recs, "frontchannel_logout")
+		if err != nil {
+			logger.Errorf("Couldn't delete user session: %v", err)
+			returnStatus(w, http.StatusInternalServerError, "Couldn't delete user session.")
+			return
+		}
+		logger.WithField("sid", sid).Infof("Front-channel logout deleted %d sessions", n)
+	default:
+		session, err := s.store.Get(r, userSessionCookie)
+		if err != nil {
+			logger.Errorf("Couldn't get user session: %v", err)
+		} else if !session.IsNew {
+			session.Options.MaxAge = -1
+			if err := session.Save(r, w); err != nil {
+				logger.Errorf("Couldn't delete user session: %v", err)
+				returnStatus(w, http.StatusInternalServerError, "Couldn't delete user session.")
+				return
+			}
+			logger.WithField("userid", session.Values[userSessionUserID]).Info("Front-channel logout deleted the browser's session")
+			s.audit.log(r, sessionAuditEvent(auditSessionRevoked, session, "frontchannel_logout"))
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The page may only be embedded by the IdP
+	issuers := []string{}
+	for _, provider := range s.providers {
+		if p == nil || provider == p {
+			issuers = append(issuers, provider.issuer)
+		}
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors "+frameAncestors(issuers))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(frontchannelLogoutPage))
+}
+
+// frameAncestors returns the origins of the issuers, for the frame-ancestors
+// directive of the Content-Security-Policy.
+func frameAncestors(issuers []string) string {
+	origins := []string{}
+	for _, issuer := range issuers {
+		u, err := url.Parse(issuer)
+		if err != nil || u.Host == "" {
+			log.Warnf("Can't get the origin of issuer %q, the front-channel logout page can't be embedded by it", issuer)
+			continue
+		}
+		origins = append(origins, u.Scheme+"://"+u.Host)
+	}
+	if len(origins) == 0 {
+		return "'none'"
+	}
+	return strings.Join(origins, " ")
+}
@@ -0,0 +1,56 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFrontchannelLogout(t *testing.T) {
+	idp := newTestProvider(t)
+	backend := newMemoryStore()
+	s := &server{providers: []*oidcProvider{idp.provider(t, defaultProviderName)}, backend: backend}
+	s.store = newStoreAdapter(backend, 60, []byte("key"))
+
+	for _, rec := range []*sessionRecord{
+		{ID: "alice-1", Kind: recordKindSession, Subject: "alice", SID: "sid-1"},
+		{ID: "alice-2", Kind: recordKindSession, Subject: "alice", SID: "sid-2"},
+	} {
+		if err := backend.Put(rec, time.Minute); err != nil {
+			t.Fatalf("Unexpected error in Put: %+v", err)
+		}
+	}
+
+	logout := func(iss, sid string) *httptest.ResponseRecorder {
+		q := url.Values{"iss": {iss}, "sid": {sid}}
+		r := httptest.NewRequest("GET", "/logout/frontchannel?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		s.frontchannelLogout(w, r)
+		return w
+	}
+
+	if w := logout("https://evil.example.com", "sid-1"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for wrong issuer, got %d", w.Code)
+	}
+	if _, err := backend.Get("alice-1"); err != nil {
+		t.Fatalf("Session deleted by logout with wrong issuer: %v", err)
+	}
+
+	w := logout(idp.URL, "sid-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status. Got %d, expected 200: %s", w.Code, w.Body.String())
+	}
+	if got, expected := w.Header().Get("Content-Security-Policy"), "default-src 'none'; frame-ancestors "+idp.URL; got != expected {
+		t.Fatalf("Wrong Content-Security-Policy. Got %q, expected %q", got, expected)
+	}
+	if _, err := backend.Get("alice-1"); err != errRecordNotFound {
+		t.Fatalf("Expected session of sid-1 to be deleted, got %v", err)
+	}
+	if _, err := backend.Get("alice-2"); err != nil {
+		t.Fatalf("Session of other sid was deleted: %v", err)
+	}
+}
@@ -3,9 +3,11 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/gob"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/gorilla/sessions"
@@ -20,11 +22,20 @@ const (
 	userSessionClaims       = "claims"
 	userSessionIDToken      = "idtoken"
 	userSessionOAuth2Tokens = "oauth2tokens"
+	// The user's subject and session id at the IdP, for back-channel logout
+	userSessionSubject = "sub"
+	userSessionSID     = "sid"
+	// The IP the user logged in from, for the admin API
+	userSessionIP = "ip"
+	// The name of the provider that issued the session
+	userSessionProvider = "provider"
 )
 
 func init() {
 	// Register type for claims.
 	gob.Register(map[string]interface{}{})
+	// Needed for list claims, e.g. groups
+	gob.Register([]interface{}{})
 	gob.Register(oauth2.Token{})
 	gob.Register(oidc.IDToken{})
 }
@@ -39,59 +50,88 @@ func getBearerToken(value string) string {
 
 func (s *server) authenticate(w http.ResponseWriter, r *http.Request) {
 
+	r, span := startServerSpan(r, "authenticate")
+	defer span.End()
 	logger := loggerForRequest(r)
 
 	// Check header for auth information.
 	// Adding it to a cookie to treat both cases uniformly.
 	// This is also required by the gorilla/sessions package.
 	// TODO(yanniszark): change to standard 'Authorization: Bearer <value>' header
+	providers := s.providersFor(r)
 	bearer := getBearerToken(r.Header.Get("Authorization"))
 	if len(bearer) != 0 {
 
-		// 1. Verify the incoming token (ensure it's issued to us)
-		verifier := s.provider.Verifier(&oidc.Config{ClientID: s.oauth2Config.ClientID})
-		idToken, err := verifier.Verify(r.Context(), bearer)
-		if err != nil {
-			logger.Errorf("Not able to verify ID token: %v", err)
-			returnStatus(w, http.StatusInternalServerError, "Unable to verify ID token.")
-			return
+		// 1. Verify the incoming token and get its claims. Opaque tokens
+		// are introspected at the providers, Kubernetes tokens are
+		// reviewed by the API server, other JWTs are verified locally.
+		var claims map[string]interface{}
+		var userIDClaim string
+		var ok bool
+		accessToken := s.accessTokens != nil && isAccessTokenJWT(bearer)
+		serviceAccount := s.tokenReviewer.reviews(bearer)
+		introspected := !isJWT(bearer) && canIntrospect(providers)
+		if introspected {
+			claims, userIDClaim, ok = s.introspectedBearerClaims(w, r, providers, bearer)
+		} else if serviceAccount {
+			claims, userIDClaim, ok = s.tokenReviewClaims(w, r, bearer)
+		} else if accessToken {
+			claims, userIDClaim, ok = s.accessTokenClaims(w, r, providers, bearer)
+		} else {
+			claims, userIDClaim, ok = s.jwtBearerClaims(w, r, providers, bearer)
 		}
-
-		// 2. Decode the token and get the claims
-		claims := map[string]interface{}{}
-
-		if err = idToken.Claims(&claims); err != nil {
-			logger.Println("Problem getting userinfo claims:", err.Error())
-			returnStatus(w, http.StatusInternalServerError, "Not able to fetch userinfo claims.")
+		if !ok {
 			return
 		}
 
-		userID := ""
-		if value, ok := claims[s.userIDOpts.claim]; ok {
-			userID = value.(string)
-		} else {
+		// 2. Get the userid from the claims
+		userID, ok := claims[userIDClaim].(string)
+		if !ok {
 			logger.Println("UserID claim was not specified... falling back to sub")
 
 			// We didn't get a UserID, but since this is probably
 			// a service account, let's just use the subject for now.
-			if value, ok := claims["sub"]; ok {
-				userID = value.(string)
+			if value, ok := claims["sub"].(string); ok {
+				userID = value
 			} else {
 				logger.Println("Unable to identify user")
+				s.bearerRejected(r, "no_user")
+				requestsTotal.WithLabelValues(outcomeError, "unknown_user").Inc()
 				returnStatus(w, http.StatusInternalServerError, "Not able to identify user.")
 				return
 			}
 		}
 
-		// 3. Set the userID header
+		// 3. Check that the user may perform the request
+		scope := ""
+		if accessToken || introspected {
+			scope, _ = claims["scope"].(string)
+		}
+		if !s.authorizeScopes(w, r, scope) || !s.authorizeRequest(w, r, claims) {
+			return
+		}
+
+		// 4. Set the userID header
 		if userID != "" {
 			w.Header().Set(s.userIDOpts.header, s.userIDOpts.prefix+userID)
 		}
 		if s.userIDOpts.tokenHeader != "" {
 			w.Header().Set(s.userIDOpts.tokenHeader, bearer)
 		}
+		if accessToken {
+			s.setAccessTokenHeaders(w, claims)
+		}
+		if serviceAccount {
+			s.setTokenReviewHeaders(w, claims)
+		}
+		s.claimHeaders.set(w, r, userID, claims)
+		if !s.setInternalJWT(w, r, userID, claims) {
+			return
+		}
+		setAuthResult(r, userID, claims)
 
-		// 4. Return HTTP OK
+		// 5. Return HTTP OK
+		requestsTotal.WithLabelValues(outcomeAllowed, "bearer_token").Inc()
 		returnStatus(w, http.StatusOK, "OK")
 		return
 	}
@@ -100,71 +140,214 @@ func (s *server) authenticate(w http.ResponseWriter, r *http.Request) {
 	session, err := s.store.Get(r, userSessionCookie)
 	if err != nil {
 		logger.Errorf("Couldn't get user session: %v", err)
+		requestsTotal.WithLabelValues(outcomeError, "session_store").Inc()
 		returnStatus(w, http.StatusInternalServerError, "Couldn't get user session.")
 		return
 	}
+	// The session must be from one of the providers of this request
+	if !session.IsNew && !containsProvider(providers, s.sessionProvider(session)) {
+		logger.Info("User session is from a provider that doesn't serve this request")
+		session.IsNew = true
+	}
+	// Refresh the session's tokens before they expire.
+	// If the IdP rejects the refresh, the session is over.
+	if !session.IsNew && needsRefresh(session, s.tokenRefreshLeeway) {
+		err := s.refreshSession(w, r, session)
+		switch {
+		case err == nil:
+		case errors.Cause(err) == errRefreshRejected:
+			session.IsNew = true
+		default:
+			// Keep using the current tokens, we'll retry on the next request
+			logger.Warnf("Couldn't refresh tokens of user session: %v", err)
+		}
+	}
+
 	// User is logged in
 	if !session.IsNew {
+		claims, _ := session.Values[userSessionClaims].(map[string]interface{})
+		if !s.authorizeScopes(w, r, "") || !s.authorizeRequest(w, r, claims) {
+			return
+		}
 		// Add userid header
 		userID := session.Values["userid"].(string)
 		if userID != "" {
 			w.Header().Set(s.userIDOpts.header, s.userIDOpts.prefix+userID)
 		}
-		if s.userIDOpts.tokenHeader != "" {
-			w.Header().Set(s.userIDOpts.tokenHeader, session.Values["idtoken"].(string))
+		// The ID token is dropped once it expires, if the provider doesn't
+		// issue a new one on refresh
+		if idToken, _ := session.Values[userSessionIDToken].(string); s.userIDOpts.tokenHeader != "" && idToken != "" {
+			w.Header().Set(s.userIDOpts.tokenHeader, idToken)
+		}
+		s.claimHeaders.set(w, r, userID, claims)
+		if !s.setInternalJWT(w, r, userID, claims) {
+			return
+		}
+		if !s.setExchangedToken(w, r, session) {
+			return
 		}
+		setAuthResult(r, userID, claims)
+		requestsTotal.WithLabelValues(outcomeAllowed, "session").Inc()
 		returnStatus(w, http.StatusOK, "OK")
 		return
 	}
 
 	// User is NOT logged in.
-	// Initiate OIDC Flow with Authorization Request.
-	state := newState(r.URL.String())
-	id, err := state.save(s.store)
+	requestsTotal.WithLabelValues(outcomeUnauthenticated, "no_session").Inc()
+	switch len(providers) {
+	case 0:
+		logger.Error("No OIDC provider serves this request")
+		returnStatus(w, http.StatusForbidden, "No OIDC provider serves this request.")
+	case 1:
+		s.startLogin(w, r, providers[0], r.URL.String())
+	default:
+		s.loginChooser(w, r, providers)
+	}
+}
+
+// startLogin initiates the OIDC flow with an Authorization Request to the
+// given provider. The user is sent back to origURL after logging in.
+func (s *server) startLogin(w http.ResponseWriter, r *http.Request, p *oidcProvider, origURL string) {
+	logger := loggerForRequest(r)
+	state := newState(origURL)
+	state.provider = p.name
+	authCodeOpts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+		oidc.Nonce(state.nonce),
+	}
+	if p.pkce {
+		state.codeVerifier = newCodeVerifier()
+		authCodeOpts = append(authCodeOpts, pkceAuthCodeOptions(state.codeVerifier)...)
+	}
+	var id string
+	err := traceStoreOp(r.Context(), "Put", func() (err error) {
+		id, err = state.save(s.backend)
+		return err
+	})
 	if err != nil {
 		logger.Errorf("Failed to save state in store: %v", err)
+		requestsTotal.WithLabelValues(outcomeError, "session_store").Inc()
 		returnStatus(w, http.StatusInternalServerError, "Failed to save state in store.")
 		return
 	}
 
-	http.Redirect(w, r, s.oauth2Config.AuthCodeURL(id, oauth2.SetAuthURLParam("prompt", "select_account")), http.StatusFound)
+	// Bind the login to this browser, see callback
+	http.SetCookie(w, newStateCookie(id))
+	loginsTotal.WithLabelValues(outcomeStarted, "").Inc()
+	http.Redirect(w, r, p.oauth2Config.AuthCodeURL(id, authCodeOpts...), http.StatusFound)
+}
+
+func containsProvider(providers []*oidcProvider, p *oidcProvider) bool {
+	for _, candidate := range providers {
+		if candidate == p {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerRejected records a rejected bearer token in the metrics and the audit
+// log.
+func (s *server) bearerRejected(r *http.Request, reason string) {
+	bearerVerificationFailuresTotal.WithLabelValues(reason).Inc()
+	s.audit.log(r, auditEvent{Type: auditBearerRejected, Reason: reason})
+}
+
+// loginFailed records a failed login in the metrics and the audit log.
+func (s *server) loginFailed(r *http.Request, reason string) {
+	loginsTotal.WithLabelValues(outcomeFailed, reason).Inc()
+	s.audit.log(r, auditEvent{Type: auditLoginFailed, Reason: reason})
 }
 
 // callback is the handler responsible for exchanging the auth_code and retrieving an id_token.
 func (s *server) callback(w http.ResponseWriter, r *http.Request) {
 
+	r, span := startServerSpan(r, "callback")
+	defer span.End()
 	logger := loggerForRequest(r)
 
-	// Get authorization code from authorization response.
-	var authCode = r.FormValue("code")
-	if len(authCode) == 0 {
-		logger.Error("Missing url parameter: code")
-		returnStatus(w, http.StatusBadRequest, "Missing url parameter: code")
-		return
-	}
-
 	// Get state and:
-	// 1. Confirm it exists in our memory.
-	// 2. Get the original URL associated with it.
+	// 1. Confirm it was started by this browser.
+	// 2. Confirm it exists in our memory.
+	// 3. Get the original URL associated with it.
 	var stateID = r.FormValue("state")
 	if len(stateID) == 0 {
 		logger.Error("Missing url parameter: state")
+		s.loginFailed(r, "missing_state")
 		returnStatus(w, http.StatusBadRequest, "Missing url parameter: state")
 		return
 	}
 
+	// Whatever the outcome, the login attempt ends with this callback.
+	// Clean up both the login cookie and the stored state. The cookies of
+	// other logins of the browser are left alone.
+	stateCookie, cookieErr := r.Cookie(stateCookieName(stateID))
+	http.SetCookie(w, deletedStateCookie(stateID))
 	// If state is loaded, then it's correct, as it is saved by its id.
-	state, err := load(s.store, stateID)
+	var state *state
+	err := traceStoreOp(r.Context(), "Get", func() (err error) {
+		state, err = load(s.backend, stateID)
+		return err
+	})
+	delErr := traceStoreOp(r.Context(), "Delete", func() error { return s.backend.Delete(stateID) })
+	if delErr != nil {
+		logger.Warnf("Failed to delete state from store: %v", delErr)
+	}
+	if cookieErr != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(stateID)) != 1 {
+		logger.Error("Login state doesn't match the login cookie, the login was not started by this browser")
+		s.loginFailed(r, "state_mismatch")
+		returnStatus(w, http.StatusForbidden, "Login was not started by this browser, please try again.")
+		return
+	}
 	if err != nil {
 		logger.Errorf("Failed to retrieve state from store: %v", err)
+		s.loginFailed(r, "invalid_state")
 		returnStatus(w, http.StatusInternalServerError, "Failed to retrieve state.")
+		return
+	}
+
+	p := s.providerByName(state.provider)
+	if p == nil {
+		logger.Errorf("Login was started with unknown provider %q", state.provider)
+		s.loginFailed(r, "unknown_provider")
+		returnStatus(w, http.StatusBadRequest, "Login was started with an unknown provider, please try again.")
+		return
+	}
+
+	// Get authorization code from authorization response.
+	var authCode = r.FormValue("code")
+	if len(authCode) == 0 {
+		logger.Error("Missing url parameter: code")
+		s.loginFailed(r, "missing_code")
+		returnStatus(w, http.StatusBadRequest, "Missing url parameter: code")
+		return
+	}
+
+	// Prove that we started this login, using the PKCE code_verifier
+	var exchangeOpts []oauth2.AuthCodeOption
+	if state.codeVerifier != "" {
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", state.codeVerifier))
+	} else if s.pkceRequired {
+		logger.Error("PKCE is required but the login state has no code_verifier")
+		s.loginFailed(r, "pkce_required")
+		returnStatus(w, http.StatusBadRequest, "Login was started without PKCE, please try again.")
+		return
 	}
 
 	ctx := setTLSContext(r.Context(), s.caBundle)
 	// Exchange the authorization code with {access, refresh, id}_token
-	oauth2Tokens, err := s.oauth2Config.Exchange(ctx, authCode)
+	exchangeStart := time.Now()
+	exchangeCtx, exchangeSpan := startSpan(ctx, "oauth2.Exchange")
+	oauth2Tokens, err := p.oauth2Config.Exchange(exchangeCtx, authCode, exchangeOpts...)
+	endSpan(exchangeSpan, err)
+	exchangeOutcome := "success"
+	if err != nil {
+		exchangeOutcome = "failure"
+	}
+	tokenExchangeDuration.WithLabelValues(exchangeOutcome).Observe(time.Since(exchangeStart).Seconds())
 	if err != nil {
 		logger.Errorf("Failed to exchange authorization code with token: %v", err)
+		s.loginFailed(r, "token_exchange")
 		returnStatus(w, http.StatusInternalServerError, "Failed to exchange authorization code with token.")
 		return
 	}
@@ -172,28 +355,61 @@ func (s *server) callback(w http.ResponseWriter, r *http.Request) {
 	rawIDToken, ok := oauth2Tokens.Extra("id_token").(string)
 	if !ok {
 		logger.Error("No id_token field available.")
+		s.loginFailed(r, "missing_id_token")
 		returnStatus(w, http.StatusInternalServerError, "No id_token field in OAuth 2.0 token.")
 		return
 	}
 
 	// Verifying received ID token
-	verifier := s.provider.Verifier(&oidc.Config{ClientID: s.oauth2Config.ClientID})
-	idToken, err := verifier.Verify(r.Context(), rawIDToken)
+	verifyCtx, verifySpan := startSpan(r.Context(), "oidc.VerifyToken")
+	idToken, err := p.verifier().Verify(verifyCtx, rawIDToken)
+	endSpan(verifySpan, err)
 	if err != nil {
 		logger.Errorf("Not able to verify ID token: %v", err)
+		s.loginFailed(r, "invalid_id_token")
 		returnStatus(w, http.StatusInternalServerError, "Unable to verify ID token.")
 		return
 	}
 
-	// UserInfo endpoint to get claims
+	// The ID token must have been issued for this login
+	if idToken.Nonce != state.nonce {
+		logger.Errorf("ID token nonce doesn't match the login state, possible replay: got %q", idToken.Nonce)
+		s.loginFailed(r, "nonce_mismatch")
+		returnStatus(w, http.StatusForbidden, "ID token nonce doesn't match the login.")
+		return
+	}
+
+	// Get the claims of the ID token
 	claims := map[string]interface{}{}
 
 	if err = idToken.Claims(&claims); err != nil {
 		logger.Println("Problem getting userinfo claims:", err.Error())
+		s.loginFailed(r, "invalid_claims")
 		returnStatus(w, http.StatusInternalServerError, "Not able to fetch userinfo claims.")
 		return
 	}
 
+	// Add the claims of the UserInfo endpoint, for providers that keep
+	// some claims (e.g. email or groups) out of the ID token
+	if p.userInfo {
+		userInfo, err := fetchUserInfo(ctx, p, oauth2Tokens, idToken.Subject)
+		if err != nil {
+			logger.Errorf("Not able to fetch userinfo claims: %v", err)
+			s.loginFailed(r, "userinfo")
+			returnStatus(w, http.StatusInternalServerError, "Not able to fetch userinfo claims.")
+			return
+		}
+		claims = mergeUserInfo(claims, userInfo)
+	}
+
+	userID, ok := claims[p.userIDClaim].(string)
+	if !ok {
+		logger.Errorf("Claims don't have a %q string claim for the userid", p.userIDClaim)
+		s.loginFailed(r, "no_userid")
+		returnStatus(w, http.StatusInternalServerError, "Not able to identify user.")
+		return
+	}
+
 	// User is authenticated, create new session.
 	session := sessions.NewSession(s.store, userSessionCookie)
 	session.Options.MaxAge = s.sessionMaxAgeSeconds
@@ -201,15 +417,24 @@ func (s *server) callback(w http.ResponseWriter, r *http.Request) {
 	session.Options.Secure = true
 	session.Options.HttpOnly = true
 
-	session.Values[userSessionUserID] = claims[s.userIDOpts.claim].(string)
+	session.Values[userSessionUserID] = userID
+	session.Values[userSessionProvider] = p.name
 	session.Values[userSessionClaims] = claims
 	session.Values[userSessionIDToken] = rawIDToken
 	session.Values[userSessionOAuth2Tokens] = oauth2Tokens
+	session.Values[userSessionSubject] = idToken.Subject
+	if sid, ok := claims["sid"].(string); ok {
+		session.Values[userSessionSID] = sid
+	}
+	session.Values[userSessionIP] = getUserIP(r)
 	if err := session.Save(r, w); err != nil {
 		logger.Errorf("Couldn't create user session: %v", err)
+	} else {
+		s.audit.log(r, sessionAuditEvent(auditSessionCreated, session, ""))
 	}
 
 	logger.Info("Login validated with ID token, redirecting.")
+	loginsTotal.WithLabelValues(outcomeCompleted, "").Inc()
 
 	// Getting original destination from DB with state
 	var destination = state.origURL
@@ -238,14 +463,26 @@ func (s *server) logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The tokens and the IdP session belong to the provider that issued
+	// the user session
+	p := s.sessionProvider(session)
+	if p == nil {
+		logger.Warn("The provider of the user session is no longer configured")
+	}
+
 	// Check if the provider has a revocation_endpoint
-	_revocationEndpoint, err := revocationEndpoint(s.provider)
+	var _revocationEndpoint string
+	if p == nil {
+		err = errors.New("unknown provider")
+	} else {
+		_revocationEndpoint, err = revocationEndpoint(p.provider)
+	}
 	if err != nil {
 		logger.Warnf("Error getting provider's revocation_endpoint: %v", err)
 	} else {
 		ctx := setTLSContext(r.Context(), s.caBundle)
 		token := session.Values[userSessionOAuth2Tokens].(oauth2.Token)
-		err := revokeTokens(ctx, _revocationEndpoint, &token, s.oauth2Config.ClientID, s.oauth2Config.ClientSecret)
+		err := revokeTokens(ctx, _revocationEndpoint, &token, p.oauth2Config.ClientID, p.oauth2Config.ClientSecret)
 		if err != nil {
 			logger.Errorf("Error revoking tokens: %v", err)
 			statusCode := http.StatusInternalServerError
@@ -261,12 +498,37 @@ func (s *server) logout(w http.ResponseWriter, r *http.Request) {
 		logger.WithField("userid", session.Values[userSessionUserID].(string)).Info("Access/Refresh tokens revoked")
 	}
 
+	// Needed to end the session at the IdP
+	idToken, _ := session.Values[userSessionIDToken].(string)
+
 	session.Options.MaxAge = -1
 	if err := sessions.Save(r, w); err != nil {
 		logger.Errorf("Couldn't delete user session: %v", err)
+	} else {
+		s.audit.log(r, sessionAuditEvent(auditSessionRevoked, session, "logout"))
 	}
 	logger.Info("Successful logout.")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	// End the user's session at the IdP too, otherwise the next request
+	// would silently log them back in.
+	var _endSessionEndpoint string
+	if p == nil {
+		err = errors.New("unknown provider")
+	} else {
+		_endSessionEndpoint, err = endSessionEndpoint(p.provider)
+	}
+	if err != nil {
+		logger.Infof("Not ending session at the provider: %v", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	logoutURL, err := endSessionURL(_endSessionEndpoint, idToken, p.oauth2Config.ClientID, s.postLogoutRedirectURI(r))
+	if err != nil {
+		logger.Errorf("Error building end session URL: %v", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, logoutURL, http.StatusSeeOther)
 }
 
 // readiness is the handler that checks if the authservice is ready for serving
@@ -290,12 +552,14 @@ func whitelistMiddleware(whitelist []string, isReady *abool.AtomicBool) func(htt
 			for _, prefix := range whitelist {
 				if strings.HasPrefix(r.URL.Path, prefix) {
 					logger.Infof("URI is whitelisted. Accepted without authorization.")
+					requestsTotal.WithLabelValues(outcomeAllowed, "whitelist").Inc()
 					returnStatus(w, http.StatusOK, "OK")
 					return
 				}
 			}
 			// If server is not ready, return 503.
 			if !isReady.IsSet() {
+				requestsTotal.WithLabelValues(outcomeError, "not_ready").Inc()
 				returnStatus(w, http.StatusServiceUnavailable, "OIDC Setup is not complete yet.")
 				return
 			}
@@ -0,0 +1,220 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// headersPresetOAuth2Proxy sets the X-Auth-Request-* headers of oauth2-proxy.
+// See: https://oauth2-proxy.github.io/oauth2-proxy/configuration/overview
+const headersPresetOAuth2Proxy = "oauth2-proxy"
+
+const defaultHeaderSeparator = ","
+
+// headersConfig maps claims to the headers of allowed requests, read from
+// HEADERS_CONFIG_PATH.
+type headersConfig struct {
+	// Preset adds a predefined set of headers, before Headers.
+	Preset  string         `yaml:"preset"`
+	Headers []headerConfig `yaml:"headers"`
+}
+
+type headerConfig struct {
+	Name string `yaml:"name"`
+	// Claim is the claim whose value is used. Nested claims are selected
+	// with a path of dot-separated keys and array indexes (e.g.
+	// "realm_access.roles" or "addresses.0.country"), unless a top-level
+	// claim has that exact name.
+	Claim string `yaml:"claim"`
+	// Prefix is added to each value.
+	Prefix string `yaml:"prefix"`
+	// Separator joins the values of array claims (default ",").
+	Separator string `yaml:"separator"`
+	// Template, if set, renders the header value. It can use .Value (the
+	// value of Claim after adding the prefix and joining), .UserID and
+	// .Claims.
+	Template string `yaml:"template"`
+
+	template *template.Template
+}
+
+// headerTemplateData is passed to header templates.
+type headerTemplateData struct {
+	Value  string
+	UserID string
+	Claims map[string]interface{}
+}
+
+var headerPresets = map[string][]headerConfig{
+	headersPresetOAuth2Proxy: {
+		{Name: "X-Auth-Request-User", Template: "{{.UserID}}"},
+		{Name: "X-Auth-Request-Email", Claim: "email"},
+		{Name: "X-Auth-Request-Preferred-Username", Claim: "preferred_username"},
+		{Name: "X-Auth-Request-Groups", Claim: "groups"},
+	},
+}
+
+// claimHeaders sets response headers from the claims of authenticated users.
+type claimHeaders struct {
+	headers []headerConfig
+}
+
+func loadClaimHeaders(path string) (*claimHeaders, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading headers config")
+	}
+	return newClaimHeaders(data)
+}
+
+func newClaimHeaders(data []byte) (*claimHeaders, error) {
+	config := headersConfig{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, errors.Wrap(err, "error parsing headers config")
+	}
+	headers := []headerConfig{}
+	if config.Preset != "" {
+		preset, ok := headerPresets[config.Preset]
+		if !ok {
+			return nil, errors.Errorf("unknown headers preset %q", config.Preset)
+		}
+		headers = append(headers, preset...)
+	}
+	headers = append(headers, config.Headers...)
+	for i := range headers {
+		h := &headers[i]
+		if h.Name == "" {
+			return nil, errors.New("header doesn't have a name")
+		}
+		if h.Claim == "" && h.Template == "" {
+			return nil, errors.Errorf("header %s must have a claim or a template", h.Name)
+		}
+		if h.Separator == "" {
+			h.Separator = defaultHeaderSeparator
+		}
+		if h.Template != "" {
+			t, err := template.New(h.Name).Option("missingkey=zero").Parse(h.Template)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid template for header %s", h.Name)
+			}
+			h.template = t
+		}
+	}
+	return &claimHeaders{headers: headers}, nil
+}
+
+// set adds the headers to the response. Headers whose claim is missing, or
+// whose value is empty, are not set.
+func (c *claimHeaders) set(w http.ResponseWriter, r *http.Request, userID string, claims map[string]interface{}) {
+	if c == nil {
+		return
+	}
+	for i := range c.headers {
+		h := &c.headers[i]
+		value, err := h.value(userID, claims)
+		if err != nil {
+			loggerForRequest(r).Warnf("Couldn't render header %s: %v", h.Name, err)
+			continue
+		}
+		if value != "" {
+			w.Header().Set(h.Name, value)
+		}
+	}
+}
+
+func (h *headerConfig) value(userID string, claims map[string]interface{}) (string, error) {
+	value := ""
+	if h.Claim != "" {
+		claim, ok := lookupClaim(claims, h.Claim)
+		if !ok {
+			return "", nil
+		}
+		values := claimValues(claim)
+		for i := range values {
+			values[i] = h.Prefix + values[i]
+		}
+		value = strings.Join(values, h.Separator)
+	}
+	if h.template != nil {
+		var buf bytes.Buffer
+		err := h.template.Execute(&buf, headerTemplateData{Value: value, UserID: userID, Claims: claims})
+		if err != nil {
+			return "", err
+		}
+		value = buf.String()
+	}
+	// Header values can't span lines
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value), nil
+}
+
+// lookupClaim returns the claim at the given path.
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := claims[path]; ok {
+		return value, true
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// claimValues returns the values of a claim as strings. Arrays have a value
+// per element, objects are encoded as JSON.
+func claimValues(claim interface{}) []string {
+	if list, ok := claim.([]interface{}); ok {
+		values := []string{}
+		for _, v := range list {
+			values = append(values, claimString(v))
+		}
+		return values
+	}
+	return []string{claimString(claim)}
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
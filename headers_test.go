@@ -0,0 +1,145 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testHeadersConfig = `
+preset: oauth2-proxy
+headers:
+- name: X-Groups
+  claim: groups
+  prefix: "oidc:"
+  separator: ";"
+- name: X-Roles
+  claim: realm_access.roles
+- name: X-Country
+  claim: addresses.0.country
+- name: X-Namespaced-Claim
+  claim: https://example.com/tenant
+- name: X-Display-Name
+  template: '{{.Claims.given_name}} {{.Claims.family_name}}'
+- name: X-Tenant
+  claim: tenant
+  template: 'tenant={{.Value}}'
+- name: X-Verified
+  claim: email_verified
+- name: X-Missing
+  claim: missing
+`
+
+func TestClaimHeaders(t *testing.T) {
+	headers, err := newClaimHeaders([]byte(testHeadersConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %+v", err)
+	}
+	claims := map[string]interface{}{
+		"email":                      "alice@example.com",
+		"email_verified":             true,
+		"preferred_username":         "alice",
+		"groups":                     []interface{}{"users", "ml-admins"},
+		"realm_access":               map[string]interface{}{"roles": []interface{}{"admin"}},
+		"addresses":                  []interface{}{map[string]interface{}{"country": "GR"}},
+		"given_name":                 "Alice",
+		"family_name":                "Smith",
+		"tenant":                     "acme\r\nX-Injected: 1",
+		"https://example.com/tenant": "acme",
+	}
+	w := httptest.NewRecorder()
+	headers.set(w, httptest.NewRequest("GET", "/", nil), "alice@example.com", claims)
+
+	want := map[string]string{
+		"X-Auth-Request-User":               "alice@example.com",
+		"X-Auth-Request-Email":              "alice@example.com",
+		"X-Auth-Request-Preferred-Username": "alice",
+		"X-Auth-Request-Groups":             "users,ml-admins",
+		"X-Groups":                          "oidc:users;oidc:ml-admins",
+		"X-Roles":                           "admin",
+		"X-Country":                         "GR",
+		"X-Namespaced-Claim":                "acme",
+		"X-Display-Name":                    "Alice Smith",
+		"X-Tenant":                          "tenant=acmeX-Injected: 1",
+		"X-Verified":                        "true",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Got %s header %q, want %q", name, got, value)
+		}
+	}
+	if _, ok := w.Header()["X-Missing"]; ok {
+		t.Error("Header of missing claim was set")
+	}
+
+	for _, config := range []string{
+		"preset: unknown\n",
+		"headers:\n- name: X-A\n",
+		"headers:\n- claim: a\n",
+		"headers:\n- name: X-A\n  template: '{{.Value'\n",
+	} {
+		if _, err := newClaimHeaders([]byte(config)); err == nil {
+			t.Errorf("Invalid config was accepted: %q", config)
+		}
+	}
+}
+
+func TestClaimHeadersSessionAndBearer(t *testing.T) {
+	headers, err := newClaimHeaders([]byte("preset: oauth2-proxy\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %+v", err)
+	}
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	p.userIDClaim = "email"
+	p.bearer.userIDClaim = "email"
+	backend := newMemoryStore()
+	s := &server{
+		providers:    []*oidcProvider{p},
+		backend:      backend,
+		store:        newStoreAdapter(backend, 60, []byte("key")),
+		claimHeaders: headers,
+	}
+	claims := map[string]interface{}{
+		"iss":    idp.URL,
+		"aud":    "authservice",
+		"sub":    "alice",
+		"email":  "alice@example.com",
+		"groups": []interface{}{"users"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+
+	bearer := httptest.NewRequest("GET", "/", nil)
+	bearer.Header.Set("Authorization", "Bearer "+idp.sign(t, claims))
+
+	// Log in by saving a session for the claims of the token
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice@example.com"
+	session.Values[userSessionClaims] = map[string]interface{}{
+		"sub": "alice", "email": "alice@example.com", "groups": []interface{}{"users"},
+	}
+	session.Values[userSessionIDToken] = "token"
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	cookie := httptest.NewRequest("GET", "/", nil)
+	cookie.AddCookie(login.Result().Cookies()[0])
+
+	for name, r := range map[string]*http.Request{"bearer": bearer, "session": cookie} {
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", name, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Auth-Request-User"); got != "alice@example.com" {
+			t.Errorf("%s: got user header %q", name, got)
+		}
+		if got := w.Header().Get("X-Auth-Request-Groups"); got != "users" {
+			t.Errorf("%s: got groups header %q", name, got)
+		}
+	}
+}
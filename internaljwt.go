@@ -0,0 +1,308 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// internalJWTKeyCheckInterval is how often the signing keys are checked for
+// rotation.
+const internalJWTKeyCheckInterval = time.Minute
+
+// internalJWTReservedClaims are set by the authservice and can't be copied
+// from the user's claims.
+var internalJWTReservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+}
+
+// signingKey is a private key that signs internal JWTs. Its id is the JWK
+// thumbprint of the public key.
+type signingKey struct {
+	jwk jose.JSONWebKey
+}
+
+func newSigningKey(key crypto.Signer) (*signingKey, error) {
+	jwk := jose.JSONWebKey{Key: key, Use: "sig"}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		jwk.Algorithm = string(jose.RS256)
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		jwk.Algorithm = string(jose.ES256)
+	default:
+		return nil, errors.Errorf("unsupported key type %T", key)
+	}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "error computing key thumbprint")
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return &signingKey{jwk: jwk}, nil
+}
+
+// generateSigningKey returns a new P-256 key.
+func generateSigningKey() (*signingKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating signing key")
+	}
+	return newSigningKey(key)
+}
+
+// parseSigningKeys parses the PEM encoded RSA or P-256 private keys.
+func parseSigningKeys(data []byte) ([]*signingKey, error) {
+	keys := []*signingKey{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing %s", block.Type)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported key type %T", key)
+		}
+		k, err := newSigningKey(signer)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no private keys found")
+	}
+	return keys, nil
+}
+
+// internalJWTMinter issues short-lived JWTs that tell upstream services who
+// the user is, signed with the authservice's own keys.
+//
+// The keys are either read from a PEM file, where the first key signs and
+// all keys are published, or generated in memory. The file is re-read when
+// it changes, so keys can be rotated by adding the new key to the file,
+// waiting for upstream services to fetch it, and moving it first. Generated
+// keys are replaced every rotation period, and the previous key stays
+// published until the next rotation.
+type internalJWTMinter struct {
+	issuer   string
+	audience string
+	ttl      time.Duration
+	// claims are copied from the user's claims
+	claims []string
+
+	keysPath string
+	rotation time.Duration
+
+	mu        sync.RWMutex
+	keys      []*signingKey
+	loadedAt  time.Time
+	keysMtime time.Time
+}
+
+func newInternalJWTMinter(issuer, audience string, ttl time.Duration, claims []string, keysPath string, rotation time.Duration) (*internalJWTMinter, error) {
+	m := &internalJWTMinter{
+		issuer:   issuer,
+		audience: audience,
+		ttl:      ttl,
+		claims:   claims,
+		keysPath: keysPath,
+		rotation: rotation,
+	}
+	if err := m.refreshKeys(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// refreshKeys reloads the keys file if it has changed, or rotates the
+// generated key if it is older than the rotation period.
+func (m *internalJWTMinter) refreshKeys() error {
+	if m.keysPath != "" {
+		info, err := os.Stat(m.keysPath)
+		if err != nil {
+			return errors.Wrap(err, "error reading signing keys")
+		}
+		m.mu.RLock()
+		unchanged := info.ModTime().Equal(m.keysMtime)
+		m.mu.RUnlock()
+		if unchanged {
+			return nil
+		}
+		data, err := ioutil.ReadFile(m.keysPath)
+		if err != nil {
+			return errors.Wrap(err, "error reading signing keys")
+		}
+		keys, err := parseSigningKeys(data)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.keys, m.keysMtime = keys, info.ModTime()
+		m.mu.Unlock()
+		log.Infof("Loaded %d internal JWT signing keys, signing with %s", len(keys), keys[0].jwk.KeyID)
+		return nil
+	}
+
+	m.mu.RLock()
+	fresh := len(m.keys) > 0 && time.Since(m.loadedAt) < m.rotation
+	m.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+	key, err := generateSigningKey()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	keys := []*signingKey{key}
+	if len(m.keys) > 0 {
+		keys = append(keys, m.keys[0])
+	}
+	m.keys, m.loadedAt = keys, time.Now()
+	m.mu.Unlock()
+	log.Infof("Generated internal JWT signing key %s", key.jwk.KeyID)
+	return nil
+}
+
+// runKeyRefresher periodically refreshes the signing keys until the returned
+// function is called.
+func (m *internalJWTMinter) runKeyRefresher(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.refreshKeys(); err != nil {
+					log.Errorf("Couldn't refresh internal JWT signing keys: %v", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// mint returns a JWT for the user, with the configured subset of the user's
+// claims.
+func (m *internalJWTMinter) mint(userID string, claims map[string]interface{}) (string, error) {
+	m.mu.RLock()
+	key := m.keys[0]
+	m.mu.RUnlock()
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(key.jwk.Algorithm),
+		Key:       key.jwk,
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", errors.Wrap(err, "error creating signer")
+	}
+	now := time.Now()
+	extra := map[string]interface{}{}
+	for _, name := range m.claims {
+		if value, ok := claims[name]; ok && !internalJWTReservedClaims[name] {
+			extra[name] = value
+		}
+	}
+	return jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:    m.issuer,
+		Subject:   userID,
+		Audience:  jwt.Audience{m.audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(m.ttl)),
+		ID:        newRecordID(),
+	}).Claims(extra).CompactSerialize()
+}
+
+// jwks returns the public keys that verify internal JWTs.
+func (m *internalJWTMinter) jwks() jose.JSONWebKeySet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	for _, k := range m.keys {
+		set.Keys = append(set.Keys, k.jwk.Public())
+	}
+	return set
+}
+
+// jwksHandler serves the public keys of the internal JWTs.
+func (m *internalJWTMinter) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Upstream services may cache the keys, but not for longer than it
+	// takes to check for a rotation
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if err := json.NewEncoder(w).Encode(m.jwks()); err != nil {
+		loggerForRequest(r).Errorf("Error writing JWKS: %v", err)
+	}
+}
+
+// jwksHandler serves the public keys of the internal JWTs, if enabled.
+func (s *server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if s.internalJWT == nil {
+		returnStatus(w, http.StatusNotFound, "Internal JWTs are not enabled.")
+		return
+	}
+	s.internalJWT.jwksHandler(w, r)
+}
+
+// setInternalJWT adds an internal JWT for the user to the response, if
+// enabled. If the JWT can't be issued, it writes an error response and
+// returns false, as upstream services rely on it.
+func (s *server) setInternalJWT(w http.ResponseWriter, r *http.Request, userID string, claims map[string]interface{}) bool {
+	if s.internalJWT == nil {
+		return true
+	}
+	token, err := s.internalJWT.mint(userID, claims)
+	if err != nil {
+		loggerForRequest(r).Errorf("Couldn't issue internal JWT: %v", err)
+		requestsTotal.WithLabelValues(outcomeError, "internal_jwt").Inc()
+		returnStatus(w, http.StatusInternalServerError, "Couldn't issue internal JWT.")
+		return false
+	}
+	w.Header().Set(s.internalJWTHeader, token)
+	return true
+}
@@ -0,0 +1,234 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// verifyInternalJWT verifies an internal JWT with the published keys and
+// returns its claims.
+func verifyInternalJWT(t *testing.T, m *internalJWTMinter, token string) map[string]interface{} {
+	t.Helper()
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing token: %+v", err)
+	}
+	set := m.jwks()
+	keys := set.Key(parsed.Headers[0].KeyID)
+	if len(keys) != 1 {
+		t.Fatalf("Key %q is not published", parsed.Headers[0].KeyID)
+	}
+	claims := map[string]interface{}{}
+	std := jwt.Claims{}
+	if err := parsed.Claims(keys[0].Key, &claims, &std); err != nil {
+		t.Fatalf("Token signature is invalid: %+v", err)
+	}
+	err = std.Validate(jwt.Expected{Issuer: m.issuer, Audience: jwt.Audience{m.audience}, Time: time.Now()})
+	if err != nil {
+		t.Fatalf("Token claims are invalid: %+v", err)
+	}
+	return claims
+}
+
+func TestInternalJWTMint(t *testing.T) {
+	m, err := newInternalJWTMinter("oidc-authservice", "kubeflow", time.Minute,
+		[]string{"email", "groups", "sub", "missing"}, "", time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error creating minter: %+v", err)
+	}
+	token, err := m.mint("alice@example.com", map[string]interface{}{
+		"sub":    "idp-subject",
+		"email":  "alice@example.com",
+		"groups": []interface{}{"users"},
+		"phone":  "555",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error minting token: %+v", err)
+	}
+	claims := verifyInternalJWT(t, m, token)
+	if claims["sub"] != "alice@example.com" {
+		t.Errorf("Got subject %v, want the userid", claims["sub"])
+	}
+	if claims["email"] != "alice@example.com" || !reflect.DeepEqual(claims["groups"], []interface{}{"users"}) {
+		t.Errorf("Selected claims were not copied: %v", claims)
+	}
+	if _, ok := claims["phone"]; ok {
+		t.Errorf("Unselected claim was copied: %v", claims)
+	}
+	if _, ok := claims["jti"]; !ok {
+		t.Errorf("Token doesn't have an id: %v", claims)
+	}
+}
+
+func TestInternalJWTGeneratedKeyRotation(t *testing.T) {
+	m, err := newInternalJWTMinter("oidc-authservice", "kubeflow", time.Minute, nil, "", time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error creating minter: %+v", err)
+	}
+	old, err := m.mint("alice", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error minting token: %+v", err)
+	}
+
+	// Not due for rotation
+	if err := m.refreshKeys(); err != nil {
+		t.Fatalf("Unexpected error refreshing keys: %+v", err)
+	}
+	if n := len(m.jwks().Keys); n != 1 {
+		t.Fatalf("Got %d keys before rotation, want 1", n)
+	}
+
+	m.loadedAt = time.Now().Add(-2 * time.Hour)
+	if err := m.refreshKeys(); err != nil {
+		t.Fatalf("Unexpected error refreshing keys: %+v", err)
+	}
+	set := m.jwks()
+	if len(set.Keys) != 2 {
+		t.Fatalf("Got %d keys after rotation, want 2", len(set.Keys))
+	}
+	if set.Keys[0].KeyID == set.Keys[1].KeyID {
+		t.Error("Key was not rotated")
+	}
+	// Tokens signed with the previous key still verify
+	verifyInternalJWT(t, m, old)
+}
+
+func TestInternalJWTKeysFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})
+
+	dir, err := ioutil.TempDir("", "internaljwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.pem")
+	if err := ioutil.WriteFile(path, rsaPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newInternalJWTMinter("oidc-authservice", "kubeflow", time.Minute, nil, path, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error creating minter: %+v", err)
+	}
+	token, err := m.mint("alice", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error minting token: %+v", err)
+	}
+	if alg := m.jwks().Keys[0].Algorithm; alg != string(jose.RS256) {
+		t.Errorf("Got algorithm %s, want %s", alg, jose.RS256)
+	}
+
+	// Publish a new key that signs, keeping the old one
+	if err := ioutil.WriteFile(path, append(ecPEM, rsaPEM...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.refreshKeys(); err != nil {
+		t.Fatalf("Unexpected error refreshing keys: %+v", err)
+	}
+	set := m.jwks()
+	if len(set.Keys) != 2 || set.Keys[0].Algorithm != string(jose.ES256) {
+		t.Fatalf("Keys were not reloaded: %+v", set.Keys)
+	}
+	verifyInternalJWT(t, m, token)
+
+	// An invalid file keeps the current keys
+	if err := ioutil.WriteFile(path, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.refreshKeys(); err == nil {
+		t.Error("Invalid keys file was accepted")
+	}
+	if len(m.jwks().Keys) != 2 {
+		t.Error("Keys were replaced by an invalid keys file")
+	}
+}
+
+func TestInternalJWTAuthenticate(t *testing.T) {
+	m, err := newInternalJWTMinter("oidc-authservice", "kubeflow", time.Minute,
+		[]string{"groups"}, "", time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error creating minter: %+v", err)
+	}
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	s := &server{
+		providers:         []*oidcProvider{p},
+		internalJWT:       m,
+		internalJWTHeader: defaultInternalJWTHeader,
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+idp.sign(t, map[string]interface{}{
+		"iss":    idp.URL,
+		"aud":    "authservice",
+		"sub":    "alice",
+		"groups": []interface{}{"users"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}))
+	w := httptest.NewRecorder()
+	s.authenticate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+	}
+	claims := verifyInternalJWT(t, m, w.Header().Get(defaultInternalJWTHeader))
+	if claims["sub"] != "alice" || !reflect.DeepEqual(claims["groups"], []interface{}{"users"}) {
+		t.Errorf("Got claims %v", claims)
+	}
+
+	w = httptest.NewRecorder()
+	s.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	set := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil || len(set.Keys) != 1 {
+		t.Fatalf("Got invalid JWKS %q: %v", w.Body.String(), err)
+	}
+	if !set.Keys[0].IsPublic() {
+		t.Error("JWKS has a private key")
+	}
+
+	// Without internal JWTs, there are no keys to serve
+	s.internalJWT = nil
+	w = httptest.NewRecorder()
+	s.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
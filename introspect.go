@@ -0,0 +1,238 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// introspectionCacheSize is the maximum number of cached introspection
+// results.
+const introspectionCacheSize = 10000
+
+var errTokenInactive = errors.New("token is not active")
+
+// introspectionEndpoint parses the OIDC Provider claims from the discovery
+// document and tries to find the introspection_endpoint.
+func introspectionEndpoint(p *oidc.Provider) (string, error) {
+	claims := struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	if claims.IntrospectionEndpoint == "" {
+		return "", errors.New("Provider doesn't have an introspection_endpoint")
+	}
+	return claims.IntrospectionEndpoint, nil
+}
+
+// introspectToken asks the IdP whether an access token is active and returns
+// the introspection response, without the active field, as the token's
+// claims. Inactive tokens return errTokenInactive.
+// The introspection procedure is described in RFC7662:
+// https://tools.ietf.org/html/rfc7662
+func introspectToken(ctx context.Context, introspectionEndpoint, token, clientID, clientSecret string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(introspectionEndpoint, "https") {
+		return nil, errors.New(fmt.Sprintf("Introspection endpoint (%v) MUST use https", introspectionEndpoint))
+	}
+	values := url.Values{}
+	values.Set("token", token)
+	values.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest(http.MethodPost, introspectionEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	setClientBasicAuth(req, clientID, clientSecret)
+
+	resp, err := doRequest(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error contacting introspection endpoint")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading introspection response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &requestError{
+			StatusCode: resp.StatusCode,
+			Err:        errors.New(fmt.Sprintf("Introspection endpoint returned code %v, server returned: %s", resp.StatusCode, body)),
+		}
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, errors.Wrap(err, "Error parsing introspection response")
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errTokenInactive
+	}
+	delete(claims, "active")
+	return claims, nil
+}
+
+type introspectionResult struct {
+	// claims is nil if the token is not active.
+	claims    map[string]interface{}
+	expiresAt time.Time
+}
+
+// introspectionCache caches introspection results, so that the IdP isn't
+// called on every request. Results are kept for at most ttl, and active
+// tokens no longer than they are valid. Entries are keyed by a hash of the
+// token, so that the cache doesn't hold usable tokens.
+type introspectionCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]introspectionResult
+}
+
+func newIntrospectionCache(ttl time.Duration, maxEntries int) *introspectionCache {
+	return &introspectionCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]introspectionResult{},
+	}
+}
+
+func introspectionCacheKey(provider, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return provider + ":" + hex.EncodeToString(sum[:])
+}
+
+// get returns the cached result for the key, if it hasn't expired.
+func (c *introspectionCache) get(key string) (introspectionResult, bool) {
+	if c == nil {
+		return introspectionResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, ok := c.entries[key]
+	if !ok || !time.Now().Before(res.expiresAt) {
+		return introspectionResult{}, false
+	}
+	return res, true
+}
+
+// put caches the claims of an active token, or nil for an inactive one.
+func (c *introspectionCache) put(key string, claims map[string]interface{}) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(c.ttl)
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(expiresAt) {
+		expiresAt = time.Unix(int64(exp), 0)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		for k, res := range c.entries {
+			if !now.Before(res.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	// Still full, make room by dropping arbitrary entries
+	for k := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, k)
+	}
+	c.entries[key] = introspectionResult{claims: claims, expiresAt: expiresAt}
+}
+
+// canIntrospect returns true if any of the providers introspects tokens.
+func canIntrospect(providers []*oidcProvider) bool {
+	for _, p := range providers {
+		if p.introspectionEndpoint != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isJWT returns true if the token looks like a JWT. Tokens that don't are
+// opaque and can only be introspected.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// introspectBearerToken introspects an opaque token at the providers of the
+// request that support introspection, in order, and returns the provider for
+// which the token is active and its claims. Providers that can't be reached
+// are skipped, their error is only returned if no other provider reports the
+// token active.
+func (s *server) introspectBearerToken(ctx context.Context, providers []*oidcProvider, token string) (*oidcProvider, map[string]interface{}, error) {
+	var introspectionErr error
+	for _, p := range providers {
+		if p.introspectionEndpoint == "" {
+			continue
+		}
+		key := introspectionCacheKey(p.name, token)
+		res, ok := s.introspectionCache.get(key)
+		if !ok {
+			claims, err := introspectToken(ctx, p.introspectionEndpoint, token, p.oauth2Config.ClientID, p.oauth2Config.ClientSecret)
+			if err != nil && err != errTokenInactive {
+				err = errors.Wrapf(err, "error introspecting token at provider %q", p.name)
+				log.Warn(err)
+				if introspectionErr == nil {
+					introspectionErr = err
+				}
+				continue
+			}
+			s.introspectionCache.put(key, claims)
+			res.claims = claims
+		}
+		if res.claims != nil {
+			return p, res.claims, nil
+		}
+	}
+	if introspectionErr != nil {
+		return nil, nil, introspectionErr
+	}
+	return nil, nil, errTokenInactive
+}
+
+// introspectedBearerClaims introspects an opaque bearer token and returns its
+// claims and the claim with the userid. If the token is rejected, it writes
+// the response and returns false.
+func (s *server) introspectedBearerClaims(w http.ResponseWriter, r *http.Request, providers []*oidcProvider, token string) (map[string]interface{}, string, bool) {
+	logger := loggerForRequest(r)
+	ctx := setTLSContext(r.Context(), s.caBundle)
+	p, claims, err := s.introspectBearerToken(ctx, providers, token)
+	if err == errTokenInactive {
+		logger.Info("Bearer token is not active")
+		s.bearerRejected(r, "inactive_token")
+		requestsTotal.WithLabelValues(outcomeUnauthenticated, "invalid_bearer_token").Inc()
+		returnStatus(w, http.StatusUnauthorized, "Token is not active.")
+		return nil, "", false
+	}
+	if err != nil {
+		logger.Errorf("Not able to introspect token: %v", err)
+		s.bearerRejected(r, "introspection_failed")
+		requestsTotal.WithLabelValues(outcomeError, "introspection_failed").Inc()
+		returnStatus(w, http.StatusInternalServerError, "Unable to introspect token.")
+		return nil, "", false
+	}
+	return claims, p.userIDClaim, true
+}
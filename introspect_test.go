@@ -0,0 +1,170 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestIntrospection(t *testing.T) {
+	var calls int32
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if id, secret, _ := r.BasicAuth(); id != "authservice" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.PostFormValue("token") {
+		case "active":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"active":   true,
+				"sub":      "alice",
+				"username": "alice@example.com",
+				"scope":    "read write",
+				"exp":      time.Now().Add(time.Hour).Unix(),
+			})
+		case "expiring":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"active": true,
+				"sub":    "bob",
+				"exp":    time.Now().Unix(),
+			})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer idp.Close()
+
+	s := &server{
+		providers: []*oidcProvider{{
+			name:                  defaultProviderName,
+			oauth2Config:          &oauth2.Config{ClientID: "authservice", ClientSecret: "secret"},
+			userIDClaim:           "username",
+			introspectionEndpoint: idp.URL + "/introspect",
+		}},
+		introspectionCache: newIntrospectionCache(time.Minute, 10),
+		userIDOpts:         userIDOpts{header: "kubeflow-userid"},
+		caBundle:           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.Certificate().Raw}),
+	}
+
+	authenticate := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		return w
+	}
+
+	tests := []struct {
+		token  string
+		status int
+		userID string
+		calls  int32
+	}{
+		{"active", http.StatusOK, "alice@example.com", 1},
+		// Cached
+		{"active", http.StatusOK, "alice@example.com", 1},
+		{"revoked", http.StatusUnauthorized, "", 2},
+		// Inactive results are cached too
+		{"revoked", http.StatusUnauthorized, "", 2},
+		// Results are not cached past the token's expiry
+		{"expiring", http.StatusOK, "bob", 3},
+		{"expiring", http.StatusOK, "bob", 4},
+	}
+	for _, test := range tests {
+		w := authenticate(test.token)
+		if w.Code != test.status {
+			t.Errorf("Token %q: got status %d, want %d", test.token, w.Code, test.status)
+		}
+		if got := w.Header().Get("kubeflow-userid"); got != test.userID {
+			t.Errorf("Token %q: got userid %q, want %q", test.token, got, test.userID)
+		}
+		if got := atomic.LoadInt32(&calls); got != test.calls {
+			t.Errorf("Token %q: got %d introspection calls, want %d", test.token, got, test.calls)
+		}
+	}
+
+	// Wrong client credentials are an introspection failure, not an
+	// inactive token
+	s.providers[0].oauth2Config.ClientSecret = "wrong"
+	if w := authenticate("other"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Got status %d with wrong client credentials, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestIntrospectionCacheBounded(t *testing.T) {
+	c := newIntrospectionCache(time.Minute, 2)
+	for _, token := range []string{"a", "b", "c"} {
+		c.put(introspectionCacheKey("p", token), map[string]interface{}{"sub": token})
+	}
+	if len(c.entries) != 2 {
+		t.Errorf("Cache has %d entries, want 2", len(c.entries))
+	}
+	if _, ok := c.get(introspectionCacheKey("p", "c")); !ok {
+		t.Error("Last cached result is missing")
+	}
+}
+
+func TestIntrospectionProviderFailure(t *testing.T) {
+	down := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("token") != "active" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"active": true,
+			"sub":    "alice",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	defer up.Close()
+
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: down.Certificate().Raw})
+	caBundle = append(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: up.Certificate().Raw})...)
+	s := &server{
+		providers: []*oidcProvider{{
+			name:                  "down",
+			oauth2Config:          &oauth2.Config{ClientID: "authservice", ClientSecret: "secret"},
+			userIDClaim:           "sub",
+			introspectionEndpoint: down.URL + "/introspect",
+		}, {
+			name:                  "up",
+			oauth2Config:          &oauth2.Config{ClientID: "authservice", ClientSecret: "secret"},
+			userIDClaim:           "sub",
+			introspectionEndpoint: up.URL + "/introspect",
+		}},
+		introspectionCache: newIntrospectionCache(time.Minute, 10),
+		userIDOpts:         userIDOpts{header: "kubeflow-userid"},
+		caBundle:           caBundle,
+	}
+	authenticate := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		return w
+	}
+
+	// The next provider is tried if one can't be reached
+	w := authenticate("active")
+	if w.Code != http.StatusOK || w.Header().Get("kubeflow-userid") != "alice" {
+		t.Errorf("Got status %d and userid %q, want %d and %q", w.Code, w.Header().Get("kubeflow-userid"), http.StatusOK, "alice")
+	}
+	// If no provider reports the token active, it may be active at the
+	// one that failed
+	if w := authenticate("revoked"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
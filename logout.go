@@ -0,0 +1,63 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+)
+
+// endSessionEndpoint parses the OIDC Provider claims from the discovery document
+// and tries to find the end_session_endpoint.
+// See: https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func endSessionEndpoint(p *oidc.Provider) (string, error) {
+	claims := struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	if claims.EndSessionEndpoint == "" {
+		return "", errors.New("Provider doesn't have an end_session_endpoint")
+	}
+	return claims.EndSessionEndpoint, nil
+}
+
+// endSessionURL builds the URL that ends the user's session at the IdP.
+// The IdP redirects the user to postLogoutRedirectURI afterwards, if set.
+func endSessionURL(endpoint, idTokenHint, clientID, postLogoutRedirectURI string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid end_session_endpoint %q", endpoint)
+	}
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	q.Set("client_id", clientID)
+	if postLogoutRedirectURI != "" {
+		q.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// postLogoutRedirectURI returns where the IdP should send the user after
+// logout. Callers can ask for a specific URI with the post_logout_redirect_uri
+// query parameter, which is only honored if it is in the allowlist.
+func (s *server) postLogoutRedirectURI(r *http.Request) string {
+	requested := r.URL.Query().Get("post_logout_redirect_uri")
+	if requested == "" {
+		return s.logoutOpts.postLogoutRedirectURI
+	}
+	for _, allowed := range s.logoutOpts.postLogoutRedirectAllowlist {
+		if requested == allowed {
+			return requested
+		}
+	}
+	loggerForRequest(r).Warnf("Ignoring post_logout_redirect_uri %q, it is not in the allowlist", requested)
+	return s.logoutOpts.postLogoutRedirectURI
+}
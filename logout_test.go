@@ -0,0 +1,177 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestEndSessionURL(t *testing.T) {
+	s := &server{logoutOpts: logoutOpts{
+		postLogoutRedirectURI:       "https://example.com/",
+		postLogoutRedirectAllowlist: []string{"https://example.com/bye"},
+	}}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", "https://example.com/"},
+		{"?post_logout_redirect_uri=https://example.com/bye", "https://example.com/bye"},
+		{"?post_logout_redirect_uri=https://evil.com/", "https://example.com/"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/logout"+test.query, nil)
+		logoutURL, err := endSessionURL("https://idp.example.com/logout?foo=bar", "token", "client", s.postLogoutRedirectURI(r))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		u, _ := url.Parse(logoutURL)
+		q := u.Query()
+		if q.Get("post_logout_redirect_uri") != test.expected {
+			t.Errorf("Wrong post_logout_redirect_uri for %q. Got %q, expected %q",
+				test.query, q.Get("post_logout_redirect_uri"), test.expected)
+		}
+		if q.Get("id_token_hint") != "token" || q.Get("client_id") != "client" || q.Get("foo") != "bar" {
+			t.Errorf("Wrong end session URL: %v", logoutURL)
+		}
+	}
+}
+
+// newLogoutTestServer returns a server for the fake provider, and a cookie of
+// a session of alice at it.
+func newLogoutTestServer(t *testing.T, idp *testProvider) (*server, *http.Cookie) {
+	p := idp.provider(t, defaultProviderName)
+	backend := newMemoryStore()
+	s := &server{
+		providers:          []*oidcProvider{p},
+		backend:            backend,
+		store:              newStoreAdapter(backend, 60, []byte("key")),
+		tokenRefreshLeeway: time.Minute,
+		logoutOpts: logoutOpts{
+			postLogoutRedirectURI:       "https://example.com/",
+			postLogoutRedirectAllowlist: []string{"https://example.com/bye"},
+		},
+	}
+
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice@example.com"
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	session.Values[userSessionIDToken] = "idtoken"
+	session.Values[userSessionProvider] = p.name
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	return s, login.Result().Cookies()[0]
+}
+
+// logoutRedirect logs out the session of the cookie and returns where the
+// user is redirected.
+func logoutRedirect(t *testing.T, s *server, cookie *http.Cookie, query string) *url.URL {
+	r := httptest.NewRequest("POST", "/logout"+query, nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.logout(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Got status %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body.String())
+	}
+	recs, err := s.backend.List()
+	if err != nil || len(recs) != 0 {
+		t.Errorf("Session was not deleted: %+v, %v", recs, err)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing redirect: %v", err)
+	}
+	return u
+}
+
+func TestLogout(t *testing.T) {
+	idp := newTestProvider(t)
+	idp.endSessionEndpoint = idp.URL + "/logout"
+
+	tests := []struct {
+		name  string
+		query string
+		// redirectURI is the post_logout_redirect_uri sent to the provider
+		redirectURI string
+	}{
+		{"default redirect", "", "https://example.com/"},
+		{"allowed redirect", "?post_logout_redirect_uri=https://example.com/bye", "https://example.com/bye"},
+		{"other redirect", "?post_logout_redirect_uri=https://evil.com/", "https://example.com/"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, cookie := newLogoutTestServer(t, idp)
+			u := logoutRedirect(t, s, cookie, test.query)
+			if got := u.Scheme + "://" + u.Host + u.Path; got != idp.endSessionEndpoint {
+				t.Fatalf("Redirected to %q, want the end_session_endpoint %q", u, idp.endSessionEndpoint)
+			}
+			q := u.Query()
+			for param, want := range map[string]string{
+				"id_token_hint":            "idtoken",
+				"client_id":                "authservice",
+				"post_logout_redirect_uri": test.redirectURI,
+			} {
+				if got := q.Get(param); got != want {
+					t.Errorf("Got %s %q, want %q", param, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogoutWithoutIDToken(t *testing.T) {
+	idp := newTestProvider(t)
+	idp.endSessionEndpoint = idp.URL + "/logout"
+	s, cookie := newLogoutTestServer(t, idp)
+
+	// The ID token is expiring and the provider doesn't return a new one on
+	// refresh, which drops it from the session
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, _ := s.store.Get(r, userSessionCookie)
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice", "exp": float64(time.Now().Unix())}
+	if err := session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	idp.tokenResponse = map[string]interface{}{"access_token": "new", "token_type": "Bearer", "expires_in": 3600}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.authenticate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+	}
+	if len(idp.tokenRequests) != 1 {
+		t.Fatalf("Got %d token requests, want 1", len(idp.tokenRequests))
+	}
+
+	q := logoutRedirect(t, s, cookie, "").Query()
+	if _, ok := q["id_token_hint"]; ok {
+		t.Errorf("Got id_token_hint %q after the ID token was dropped", q.Get("id_token_hint"))
+	}
+	if got := q.Get("client_id"); got != "authservice" {
+		t.Errorf("Got client_id %q, want %q", got, "authservice")
+	}
+}
+
+func TestLogoutWithoutEndSessionEndpoint(t *testing.T) {
+	idp := newTestProvider(t)
+	s, cookie := newLogoutTestServer(t, idp)
+	if u := logoutRedirect(t, s, cookie, ""); u.String() != "/" {
+		t.Errorf("Redirected to %q, want %q", u, "/")
+	}
+}
@@ -4,17 +4,14 @@ package main
 
 import (
 	"context"
-	"github.com/boltdb/bolt"
-	"github.com/coreos/go-oidc"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	log "github.com/sirupsen/logrus"
 	"github.com/tevino/abool"
-	"github.com/yosssi/boltstore/reaper"
-	"github.com/yosssi/boltstore/store"
-	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -24,83 +21,368 @@ import (
 
 // Option Defaults
 const (
-	defaultHealthServerPort  = "8081"
-	defaultServerHostname    = ""
-	defaultServerPort        = "8080"
-	defaultUserIDHeader      = "kubeflow-userid"
-	defaultUserIDTokenHeader = "kubeflow-userid-token"
-	defaultUserIDPrefix      = ""
-	defaultUserIDClaim       = "email"
-	defaultSessionMaxAge     = "86400"
+	defaultHealthServerPort       = "8081"
+	defaultServerHostname         = ""
+	defaultServerPort             = "8080"
+	defaultUserIDHeader           = "kubeflow-userid"
+	defaultUserIDTokenHeader      = "kubeflow-userid-token"
+	defaultUserIDPrefix           = ""
+	defaultUserIDClaim            = "email"
+	defaultSessionMaxAge          = "86400"
+	defaultStoreType              = storeTypeBolt
+	defaultRedisAddr              = "127.0.0.1:6379"
+	defaultRedisDB                = "0"
+	defaultStoreSweepInterval     = "5m"
+	defaultTokenRefreshLeeway     = "1m"
+	defaultTokenIntrospection     = "false"
+	defaultUserInfo               = "false"
+	defaultIntrospectionTTL       = "1m"
+	defaultTokenReview            = "false"
+	defaultKubernetesTokenPath    = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultKubernetesCAPath       = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	defaultTokenReviewIssuers     = "https://kubernetes.default.svc.cluster.local kubernetes/serviceaccount"
+	defaultTokenReviewCacheTTL    = "1m"
+	defaultTokenReviewNegativeTTL = "10s"
+	defaultGroupsHeader           = "kubeflow-groups"
+	defaultInternalJWTHeader      = "authservice-jwt"
+	defaultInternalJWTIssuer      = "oidc-authservice"
+	defaultInternalJWTTTL         = "5m"
+	defaultInternalJWTClaims      = "email groups"
+	defaultInternalJWTKeyRotation = "24h"
+	defaultInternalJWTJWKSPath    = "/.well-known/jwks.json"
+	defaultPKCEMode               = pkceModeAuto
+	defaultTracesExporter         = tracesExporterNone
+)
+
+// Supported values for STORE_TYPE
+const (
+	storeTypeBolt     = "boltdb"
+	storeTypeMemory   = "memory"
+	storeTypeRedis    = "redis"
+	storeTypePostgres = "postgres"
+	storeTypeSQLite   = "sqlite"
 )
 
 // Issue: https://github.com/gorilla/sessions/issues/200
 const secureCookieKeyPair = "notNeededBecauseCookieValueIsRandom"
 
 type server struct {
-	provider             *oidc.Provider
-	oauth2Config         *oauth2.Config
+	providers            []*oidcProvider
+	bearerIssuers        *bearerIssuers
+	introspectionCache   *introspectionCache
+	accessTokens         *accessTokenConfig
+	claimHeaders         *claimHeaders
+	tokenExchange        *tokenExchangeConfig
+	tokenReviewer        *tokenReviewer
+	internalJWT          *internalJWTMinter
+	internalJWTHeader    string
 	store                sessions.Store
+	backend              sessionStore
 	staticDestination    string
 	sessionMaxAgeSeconds int
+	authorizer           *authorizer
+	// pkceRequired is true if logins without PKCE are rejected.
+	pkceRequired       bool
+	tokenRefreshLeeway time.Duration
+	// sessionRefreshes serializes the token refreshes of each session
+	sessionRefreshes singleflight.Group
+	audit            *auditLogger
 	userIDOpts
+	logoutOpts
 	caBundle []byte
 }
 
+type logoutOpts struct {
+	postLogoutRedirectURI       string
+	postLogoutRedirectAllowlist []string
+}
+
 type userIDOpts struct {
 	header      string
 	tokenHeader string
 	prefix      string
-	claim       string
 }
 
 func main() {
 
-	// Start readiness probe immediately
-	log.Infof("Starting readiness probe at %v", defaultHealthServerPort)
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit-log" {
+		verifyAuditLogCommand(os.Args[2:])
+		return
+	}
+
+	// Start readiness probe and metrics immediately
+	log.Infof("Starting readiness probe and metrics at %v", defaultHealthServerPort)
 	isReady := abool.New()
 	go func() {
-		log.Fatal(http.ListenAndServe(":"+defaultHealthServerPort, http.HandlerFunc(readiness(isReady))))
+		log.Fatal(http.ListenAndServe(":"+defaultHealthServerPort, healthHandler(isReady)))
 	}()
 
 	/////////////
 	// Options //
 	/////////////
 
-	// OIDC Provider
-	providerURL := getURLEnvOrDie("OIDC_PROVIDER")
-	authURL := os.Getenv("OIDC_AUTH_URL")
+	// OIDC Providers
+	providersConfigPath := os.Getenv("PROVIDERS_CONFIG_PATH")
+	trustedIssuersConfigPath := os.Getenv("TRUSTED_ISSUERS_CONFIG_PATH")
+	accessTokenConfigPath := os.Getenv("ACCESS_TOKEN_CONFIG_PATH")
+	tokenExchangeConfigPath := os.Getenv("TOKEN_EXCHANGE_CONFIG_PATH")
+	// Kubernetes TokenReview Options
+	tokenReviewEnabled, err := strconv.ParseBool(getEnvOrDefault("KUBERNETES_TOKENREVIEW", defaultTokenReview))
+	if err != nil {
+		log.Fatalf("Couldn't parse KUBERNETES_TOKENREVIEW: %v", err)
+	}
+	kubernetesAPIURL := os.Getenv("KUBERNETES_API_URL")
+	if kubernetesAPIURL == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		kubernetesAPIURL = "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	kubernetesTokenPath := getEnvOrDefault("KUBERNETES_TOKEN_PATH", defaultKubernetesTokenPath)
+	kubernetesCAPath := getEnvOrDefault("KUBERNETES_CA_PATH", defaultKubernetesCAPath)
+	tokenReviewIssuers := clean(strings.Split(getEnvOrDefault("TOKENREVIEW_ISSUERS", defaultTokenReviewIssuers), " "))
+	tokenReviewAudiences := clean(strings.Split(os.Getenv("TOKENREVIEW_AUDIENCES"), " "))
+	tokenReviewCacheTTL := getEnvOrDefault("TOKENREVIEW_CACHE_TTL", defaultTokenReviewCacheTTL)
+	tokenReviewNegativeTTL := getEnvOrDefault("TOKENREVIEW_NEGATIVE_CACHE_TTL", defaultTokenReviewNegativeTTL)
+	groupsHeader := getEnvOrDefault("GROUPS_HEADER", defaultGroupsHeader)
+	introspectionCacheTTL := getEnvOrDefault("INTROSPECTION_CACHE_TTL", defaultIntrospectionTTL)
 	caBundlePath := os.Getenv("CA_BUNDLE")
-	// OIDC Client
-	oidcScopes := clean(strings.Split(getEnvOrDie("OIDC_SCOPES"), " "))
-	clientID := getEnvOrDie("CLIENT_ID")
-	clientSecret := getEnvOrDie("CLIENT_SECRET")
-	redirectURL := getURLEnvOrDie("REDIRECT_URL")
+	pkceMode := getEnvOrDefault("PKCE_MODE", defaultPKCEMode)
 	staticDestination := os.Getenv("STATIC_DESTINATION_URL")
 	whitelist := clean(strings.Split(os.Getenv("SKIP_AUTH_URI"), " "))
+	authzConfigPath := os.Getenv("AUTHZ_CONFIG_PATH")
+	// Logout Options
+	postLogoutRedirectURI := os.Getenv("POST_LOGOUT_REDIRECT_URI")
+	postLogoutRedirectAllowlist := clean(strings.Split(os.Getenv("POST_LOGOUT_REDIRECT_URI_ALLOWLIST"), " "))
+	frontchannelLogoutPath := os.Getenv("FRONTCHANNEL_LOGOUT_PATH")
 	// UserID Options
 	userIDHeader := getEnvOrDefault("USERID_HEADER", defaultUserIDHeader)
 	userIDTokenHeader := getEnvOrDefault("USERID_TOKEN_HEADER", defaultUserIDTokenHeader)
 	userIDPrefix := getEnvOrDefault("USERID_PREFIX", defaultUserIDPrefix)
 	userIDClaim := getEnvOrDefault("USERID_CLAIM", defaultUserIDClaim)
+	headersConfigPath := os.Getenv("HEADERS_CONFIG_PATH")
+	// Internal JWT Options
+	internalJWTAudience := os.Getenv("INTERNAL_JWT_AUDIENCE")
+	internalJWTHeader := getEnvOrDefault("INTERNAL_JWT_HEADER", defaultInternalJWTHeader)
+	internalJWTIssuer := getEnvOrDefault("INTERNAL_JWT_ISSUER", defaultInternalJWTIssuer)
+	internalJWTTTL := getEnvOrDefault("INTERNAL_JWT_TTL", defaultInternalJWTTTL)
+	internalJWTClaims := clean(strings.Split(getEnvOrDefault("INTERNAL_JWT_CLAIMS", defaultInternalJWTClaims), " "))
+	internalJWTKeysPath := os.Getenv("INTERNAL_JWT_KEYS_PATH")
+	internalJWTKeyRotation := getEnvOrDefault("INTERNAL_JWT_KEY_ROTATION", defaultInternalJWTKeyRotation)
+	internalJWTJWKSPath := getEnvOrDefault("INTERNAL_JWT_JWKS_PATH", defaultInternalJWTJWKSPath)
+	// Without a providers config, a single provider is configured through
+	// env variables.
+	var providerConfigs []providerConfig
+	if providersConfigPath == "" {
+		tokenIntrospection, err := strconv.ParseBool(getEnvOrDefault("TOKEN_INTROSPECTION", defaultTokenIntrospection))
+		if err != nil {
+			log.Fatalf("Couldn't parse TOKEN_INTROSPECTION: %v", err)
+		}
+		userInfo, err := strconv.ParseBool(getEnvOrDefault("OIDC_USERINFO", defaultUserInfo))
+		if err != nil {
+			log.Fatalf("Couldn't parse OIDC_USERINFO: %v", err)
+		}
+		providerConfigs = []providerConfig{{
+			Name:          defaultProviderName,
+			Issuer:        getURLEnvOrDie("OIDC_PROVIDER").String(),
+			AuthURL:       os.Getenv("OIDC_AUTH_URL"),
+			ClientID:      getEnvOrDie("CLIENT_ID"),
+			ClientSecret:  getEnvOrDie("CLIENT_SECRET"),
+			Scopes:        clean(strings.Split(getEnvOrDie("OIDC_SCOPES"), " ")),
+			RedirectURL:   getURLEnvOrDie("REDIRECT_URL").String(),
+			Introspection: tokenIntrospection,
+			UserInfo:      userInfo,
+		}}
+	}
 	// Server
 	hostname := getEnvOrDefault("SERVER_HOSTNAME", defaultServerHostname)
 	port := getEnvOrDefault("SERVER_PORT", defaultServerPort)
+	extAuthzGRPCPort := os.Getenv("EXT_AUTHZ_GRPC_PORT")
+	adminPort := os.Getenv("ADMIN_PORT")
+	tracesExporter := getEnvOrDefault("OTEL_TRACES_EXPORTER", defaultTracesExporter)
+	auditLogPath := os.Getenv("AUDIT_LOG")
+	auditLogHMACKey := os.Getenv("AUDIT_LOG_HMAC_KEY")
+	adminToken := ""
+	if adminPort != "" {
+		adminToken = getEnvOrDie("ADMIN_TOKEN")
+	}
 	// Store
-	storePath := getEnvOrDie("STORE_PATH")
+	storeType := getEnvOrDefault("STORE_TYPE", defaultStoreType)
+	storePath := os.Getenv("STORE_PATH")
+	redisAddr := getEnvOrDefault("REDIS_ADDR", defaultRedisAddr)
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	redisDB := getEnvOrDefault("REDIS_DB", defaultRedisDB)
+	postgresDSN := os.Getenv("POSTGRES_DSN")
+	storeSweepInterval := getEnvOrDefault("STORE_SWEEP_INTERVAL", defaultStoreSweepInterval)
 	// Sessions
 	sessionMaxAge := getEnvOrDefault("SESSION_MAX_AGE", defaultSessionMaxAge)
+	tokenRefreshLeeway := getEnvOrDefault("TOKEN_REFRESH_LEEWAY", defaultTokenRefreshLeeway)
+
+	switch storeType {
+	case storeTypeBolt, storeTypeSQLite:
+		if storePath == "" {
+			log.Fatal("Env variable STORE_PATH missing, exiting.")
+		}
+	case storeTypePostgres:
+		if postgresDSN == "" {
+			log.Fatal("Env variable POSTGRES_DSN missing, exiting.")
+		}
+	case storeTypeMemory:
+		log.Warn("Using in-memory store, sessions will be lost on restart.")
+	case storeTypeRedis:
+	default:
+		log.Fatalf("Unknown store type: %v", storeType)
+	}
+
+	switch pkceMode {
+	case pkceModeAuto, pkceModeRequired, pkceModeDisabled:
+	default:
+		log.Fatalf("Unknown PKCE mode: %v", pkceMode)
+	}
+
+	// Tracing
+	shutdownTracing, err := setupTracing(context.Background(), tracesExporter)
+	if err != nil {
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// OIDC providers config
+	if providersConfigPath != "" {
+		providerConfigs, err = loadProvidersConfig(providersConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading providers config: %v", err)
+		}
+	}
+	for i := range providerConfigs {
+		c := &providerConfigs[i]
+		if c.RedirectURL == "" {
+			c.RedirectURL = getURLEnvOrDie("REDIRECT_URL").String()
+		}
+		if c.UserIDClaim == "" {
+			c.UserIDClaim = userIDClaim
+		}
+	}
+
+	// Trusted issuers of bearer tokens
+	var trustedIssuers []trustedIssuerConfig
+	if trustedIssuersConfigPath != "" {
+		trustedIssuers, err = loadTrustedIssuersConfig(trustedIssuersConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading trusted issuers config: %v", err)
+		}
+	}
+	for i := range trustedIssuers {
+		if trustedIssuers[i].UserIDClaim == "" {
+			trustedIssuers[i].UserIDClaim = userIDClaim
+		}
+	}
+
+	// JWT access tokens
+	var accessTokens *accessTokenConfig
+	if accessTokenConfigPath != "" {
+		accessTokens, err = loadAccessTokenConfig(accessTokenConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading access token config: %v", err)
+		}
+	}
+
+	// Token exchange
+	var tokenExchange *tokenExchangeConfig
+	if tokenExchangeConfigPath != "" {
+		tokenExchange, err = loadTokenExchangeConfig(tokenExchangeConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading token exchange config: %v", err)
+		}
+	}
+
+	// Kubernetes TokenReview
+	var reviewer *tokenReviewer
+	if tokenReviewEnabled {
+		if kubernetesAPIURL == "" {
+			log.Fatal("KUBERNETES_API_URL must be set when not running in a Kubernetes cluster")
+		}
+		cacheTTL, err := time.ParseDuration(tokenReviewCacheTTL)
+		if err != nil {
+			log.Fatalf("Couldn't parse TokenReview cache TTL: %v", err)
+		}
+		negativeTTL, err := time.ParseDuration(tokenReviewNegativeTTL)
+		if err != nil {
+			log.Fatalf("Couldn't parse TokenReview negative cache TTL: %v", err)
+		}
+		reviewer, err = newTokenReviewer(kubernetesAPIURL, kubernetesTokenPath, kubernetesCAPath,
+			tokenReviewAudiences, tokenReviewIssuers, groupsHeader, cacheTTL, negativeTTL)
+		if err != nil {
+			log.Fatalf("Error setting up Kubernetes TokenReview: %v", err)
+		}
+	}
+
+	// Claim headers
+	var headers *claimHeaders
+	if headersConfigPath != "" {
+		headers, err = loadClaimHeaders(headersConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading headers config: %v", err)
+		}
+	}
+
+	// Internal JWTs
+	var internalJWT *internalJWTMinter
+	if internalJWTAudience != "" {
+		ttl, err := time.ParseDuration(internalJWTTTL)
+		if err != nil {
+			log.Fatalf("Couldn't parse internal JWT TTL: %v", err)
+		}
+		rotation, err := time.ParseDuration(internalJWTKeyRotation)
+		if err != nil {
+			log.Fatalf("Couldn't parse internal JWT key rotation: %v", err)
+		}
+		if internalJWTKeysPath == "" {
+			log.Warn("Using generated internal JWT signing keys, which are not shared between replicas.")
+		}
+		internalJWT, err = newInternalJWTMinter(internalJWTIssuer, internalJWTAudience, ttl, internalJWTClaims, internalJWTKeysPath, rotation)
+		if err != nil {
+			log.Fatalf("Error setting up internal JWTs: %v", err)
+		}
+		defer internalJWT.runKeyRefresher(internalJWTKeyCheckInterval)()
+	}
+
+	// Audit log
+	var audit *auditLogger
+	if auditLogPath != "" {
+		audit, err = newAuditLogger(auditLogPath, []byte(auditLogHMACKey))
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+	}
+
+	// Authorization policy
+	var authz *authorizer
+	if authzConfigPath != "" {
+		authz, err = loadAuthorizer(authzConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading authorization config: %v", err)
+		}
+	}
 
 	/////////////////////////////////////////////////////
 	// Start server immediately for whitelisted routes //
 	/////////////////////////////////////////////////////
 
 	s := &server{}
+	registerStateMetrics(isReady, s)
 
 	// Register handlers for routes
 	router := mux.NewRouter()
 	router.HandleFunc("/login/oidc", s.callback).Methods(http.MethodGet)
+	router.HandleFunc("/login/start", s.loginStart).Methods(http.MethodGet)
 	router.HandleFunc("/logout", s.logout).Methods(http.MethodGet)
+	router.HandleFunc("/logout/backchannel", s.backchannelLogout).Methods(http.MethodPost)
+	// These routes take precedence over the applications behind the
+	// authservice, so they are only served when enabled
+	if frontchannelLogoutPath != "" {
+		router.HandleFunc(frontchannelLogoutPath, s.frontchannelLogout).Methods(http.MethodGet)
+	}
+	if internalJWT != nil {
+		router.HandleFunc(internalJWTJWKSPath, s.jwksHandler).Methods(http.MethodGet)
+	}
 	router.PathPrefix("/").HandlerFunc(s.authenticate)
 
 	// Start server
@@ -111,9 +393,20 @@ func main() {
 		close(stopCh)
 	}(stopCh)
 
+	// Start Envoy ext_authz gRPC server, if enabled
+	if extAuthzGRPCPort != "" {
+		log.Infof("Starting ext_authz gRPC server at %v:%v", hostname, extAuthzGRPCPort)
+		go func() {
+			lis, err := net.Listen("tcp", hostname+":"+extAuthzGRPCPort)
+			if err != nil {
+				log.Fatalf("Error listening for ext_authz gRPC server: %v", err)
+			}
+			log.Fatal(newExtAuthzGRPCServer(whitelistMiddleware(whitelist, isReady)(router)).Serve(lis))
+		}()
+	}
+
 	// Read CA bundle
 	var caBundle []byte
-	var err error
 	if caBundlePath != "" {
 		caBundle, err = ioutil.ReadFile(caBundlePath)
 		if err != nil {
@@ -126,72 +419,119 @@ func main() {
 	/////////////////////////////////
 
 	// OIDC Discovery
-	var provider *oidc.Provider
+	providers := []*oidcProvider{}
 	ctx := setTLSContext(context.Background(), caBundle)
-	for {
-		provider, err = oidc.NewProvider(ctx, providerURL.String())
-		if err == nil {
-			break
+	for _, c := range providerConfigs {
+		var provider *oidcProvider
+		for {
+			discoveryCtx, span := startSpan(ctx, "oidc.Discovery")
+			provider, err = newOIDCProvider(discoveryCtx, c, pkceMode)
+			endSpan(span, err)
+			if err == nil {
+				break
+			}
+			log.Errorf("OIDC provider setup failed, retrying in 10 seconds: %v", err)
+			time.Sleep(10 * time.Second)
 		}
-		log.Errorf("OIDC provider setup failed, retrying in 10 seconds: %v", err)
-		time.Sleep(10 * time.Second)
+		log.Infof("OIDC provider %q ready, PKCE enabled: %v", provider.name, provider.pkce)
+		providers = append(providers, provider)
 	}
 
-	endpoint := provider.Endpoint()
-	if authURL != "" {
-		endpoint.AuthURL = authURL
+	// Session Max-Age in seconds
+	sessionMaxAgeSeconds, err := strconv.Atoi(sessionMaxAge)
+	if err != nil {
+		log.Fatalf("Couldn't convert session MaxAge to int: %v", err)
 	}
 
-	oidcScopes = append(oidcScopes, oidc.ScopeOpenID)
-
-	// Setup Store
-	// Using BoltDB by default
-	db, err := bolt.Open(storePath, 0666, nil)
+	// Refresh tokens this long before they expire
+	tokenRefreshLeewayDuration, err := time.ParseDuration(tokenRefreshLeeway)
 	if err != nil {
-		log.Fatalf("Error opening bolt store: %v", err)
+		log.Fatalf("Couldn't parse token refresh leeway: %v", err)
 	}
-	defer db.Close()
-	// Invoke a reaper which checks and removes expired sessions periodically.
-	defer reaper.Quit(reaper.Run(db, reaper.Options{}))
-	store, err := store.New(db, store.Config{}, []byte(secureCookieKeyPair))
+
+	// Cache introspection results for this long
+	introspectionCacheTTLDuration, err := time.ParseDuration(introspectionCacheTTL)
 	if err != nil {
-		log.Fatalf("Error creating session store: %v", err)
+		log.Fatalf("Couldn't parse introspection cache TTL: %v", err)
 	}
 
-	// Session Max-Age in seconds
-	sessionMaxAgeSeconds, err := strconv.Atoi(sessionMaxAge)
+	// Setup Store
+	var backend sessionStore
+	switch storeType {
+	case storeTypeBolt:
+		backend, err = newBoltStore(storePath)
+	case storeTypeMemory:
+		backend = newMemoryStore()
+	case storeTypeRedis:
+		db, convErr := strconv.Atoi(redisDB)
+		if convErr != nil {
+			log.Fatalf("Couldn't convert Redis DB to int: %v", convErr)
+		}
+		backend, err = newRedisStore(newRedisPool(redisAddr, redisPassword, db))
+	case storeTypePostgres:
+		backend, err = newSQLStore(postgresDialect, postgresDSN)
+	case storeTypeSQLite:
+		backend, err = newSQLStore(sqliteDialect, storePath)
+	}
 	if err != nil {
-		log.Fatalf("Couldn't convert session MaxAge to int: %v", err)
+		log.Fatalf("Error creating session store: %v", err)
+	}
+	defer backend.Close()
+	// Periodically remove expired records from stores that don't expire
+	// them on their own.
+	if sw, ok := backend.(sweeper); ok {
+		interval, err := time.ParseDuration(storeSweepInterval)
+		if err != nil {
+			log.Fatalf("Couldn't parse store sweep interval: %v", err)
+		}
+		defer runSweeper(sw, interval)()
 	}
+	store := newStoreAdapter(backend, sessionMaxAgeSeconds, []byte(secureCookieKeyPair))
 
 	// Set the server values.
 	// The isReady atomic variable should protect it from concurrency issues.
 
 	*s = server{
-		provider: provider,
-		oauth2Config: &oauth2.Config{
-			ClientID:     clientID,
-			ClientSecret: clientSecret,
-			Endpoint:     endpoint,
-			RedirectURL:  redirectURL.String(),
-			Scopes:       oidcScopes,
-		},
-		// TODO: Add support for Redis
-		store:             store,
-		staticDestination: staticDestination,
+		providers:          providers,
+		bearerIssuers:      newBearerIssuers(ctx, trustedIssuers),
+		accessTokens:       accessTokens,
+		claimHeaders:       headers,
+		tokenExchange:      tokenExchange,
+		tokenReviewer:      reviewer,
+		internalJWT:        internalJWT,
+		internalJWTHeader:  internalJWTHeader,
+		introspectionCache: newIntrospectionCache(introspectionCacheTTLDuration, introspectionCacheSize),
+		store:              store,
+		backend:            backend,
+		staticDestination:  staticDestination,
 		userIDOpts: userIDOpts{
 			header:      userIDHeader,
 			tokenHeader: userIDTokenHeader,
 			prefix:      userIDPrefix,
-			claim:       userIDClaim,
+		},
+		logoutOpts: logoutOpts{
+			postLogoutRedirectURI:       postLogoutRedirectURI,
+			postLogoutRedirectAllowlist: postLogoutRedirectAllowlist,
 		},
 		sessionMaxAgeSeconds: sessionMaxAgeSeconds,
+		authorizer:           authz,
+		pkceRequired:         pkceMode == pkceModeRequired,
+		tokenRefreshLeeway:   tokenRefreshLeewayDuration,
+		audit:                audit,
 		caBundle:             caBundle,
 	}
 
 	// Setup complete, mark server ready
 	isReady.Set()
 
+	// Start admin API server, if enabled
+	if adminPort != "" {
+		log.Infof("Starting admin API server at %v:%v", hostname, adminPort)
+		go func() {
+			log.Fatal(http.ListenAndServe(hostname+":"+adminPort, s.adminHandler(adminToken)))
+		}()
+	}
+
 	// Block until server exits
 	<-stopCh
 }
@@ -0,0 +1,112 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStore is a sessionStore that keeps records in memory.
+// Records are lost on restart and aren't shared between replicas, so it is
+// only suitable for tests and development.
+type memoryStore struct {
+	mu      sync.RWMutex
+	records map[string][]byte
+	expiry  map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records: map[string][]byte{},
+		expiry:  map[string]time.Time{},
+	}
+}
+
+func (s *memoryStore) Get(id string) (*sessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.records[id]
+	if !ok || !time.Now().Before(s.expiry[id]) {
+		return nil, errRecordNotFound
+	}
+	// Records are kept encoded, so that callers can't modify stored values.
+	return decodeRecord(data)
+}
+
+func (s *memoryStore) Put(rec *sessionRecord, ttl time.Duration) error {
+	rec.ExpiresAt = time.Now().Add(ttl)
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.ID] = data
+	s.expiry[rec.ID] = rec.ExpiresAt
+	return nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	delete(s.expiry, id)
+	return nil
+}
+
+func (s *memoryStore) List() ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return true })
+}
+
+func (s *memoryStore) ListByUser(userID string) ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return rec.UserID == userID })
+}
+
+func (s *memoryStore) ListBySubject(sub string) ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return rec.Subject == sub })
+}
+
+func (s *memoryStore) ListBySID(sid string) ([]*sessionRecord, error) {
+	return s.list(func(rec *sessionRecord) bool { return rec.SID == sid })
+}
+
+// list returns all unexpired records for which match returns true.
+func (s *memoryStore) list(match func(*sessionRecord) bool) ([]*sessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	res := []*sessionRecord{}
+	for id, data := range s.records {
+		if !now.Before(s.expiry[id]) {
+			continue
+		}
+		rec, err := decodeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		if match(rec) {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) sweep() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for id, expiry := range s.expiry {
+		if !now.Before(expiry) {
+			delete(s.records, id)
+			delete(s.expiry, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,146 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/tevino/abool"
+)
+
+const metricsNamespace = "authservice"
+
+// Outcomes of requests
+const (
+	outcomeAllowed         = "allowed"
+	outcomeDenied          = "denied"
+	outcomeUnauthenticated = "unauthenticated"
+	outcomeError           = "error"
+)
+
+// Outcomes of logins
+const (
+	outcomeStarted   = "started"
+	outcomeCompleted = "completed"
+	outcomeFailed    = "failed"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests checked by the authservice, by outcome and reason.",
+	}, []string{"outcome", "reason"})
+	loginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "logins_total",
+		Help:      "OIDC logins started, completed and failed, by reason.",
+	}, []string{"outcome", "reason"})
+	bearerVerificationFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bearer_verification_failures_total",
+		Help:      "Bearer tokens that failed verification, by reason.",
+	}, []string{"reason"})
+	tokenRevocationErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_revocation_errors_total",
+		Help:      "Errors revoking tokens at the IdP, by token type and reason.",
+	}, []string{"token_type", "reason"})
+	tokenExchangeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_exchange_duration_seconds",
+		Help:      "Latency of exchanging authorization codes for tokens at the IdP, by outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		loginsTotal,
+		bearerVerificationFailuresTotal,
+		tokenRevocationErrorsTotal,
+		tokenExchangeDuration,
+	)
+}
+
+// activeSessionsCacheTTL is how long the count of active sessions is cached.
+// Counting decodes every record in the store, so it isn't done on every
+// scrape.
+const activeSessionsCacheTTL = time.Minute
+
+// sessionCounter counts the active sessions, caching the count for ttl.
+type sessionCounter struct {
+	count func() (int, error)
+	ttl   time.Duration
+
+	mu        sync.Mutex
+	value     float64
+	countedAt time.Time
+}
+
+// get returns the cached count, counting the sessions again if it's older
+// than the TTL. If counting fails, the last count is returned and counting is
+// retried on the next call.
+func (c *sessionCounter) get() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.countedAt.IsZero() && time.Since(c.countedAt) < c.ttl {
+		return c.value
+	}
+	n, err := c.count()
+	if err != nil {
+		log.Errorf("Couldn't count sessions for metrics: %v", err)
+		return c.value
+	}
+	c.value, c.countedAt = float64(n), time.Now()
+	return c.value
+}
+
+// registerStateMetrics registers the gauges that report the state of the
+// authservice, which are computed on scrape.
+func registerStateMetrics(isReady *abool.AtomicBool, s *server) {
+	sessions := &sessionCounter{
+		count: func() (int, error) {
+			recs, err := s.listSessions("")
+			return len(recs), err
+		},
+		ttl: activeSessionsCacheTTL,
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ready",
+			Help:      "Whether the authservice is ready to serve requests.",
+		}, func() float64 {
+			if isReady.IsSet() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_sessions",
+			Help:      "Unexpired user sessions in the store, counted at most once a minute.",
+		}, func() float64 {
+			// The store is set up asynchronously
+			if !isReady.IsSet() {
+				return 0
+			}
+			return sessions.get()
+		}),
+	)
+}
+
+// healthHandler serves the readiness probe and the Prometheus metrics.
+func healthHandler(isReady *abool.AtomicBool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/", readiness(isReady))
+	return mux
+}
@@ -0,0 +1,75 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tevino/abool"
+)
+
+func TestMetrics(t *testing.T) {
+	isReady := abool.New()
+	handler := whitelistMiddleware([]string{"/public"}, isReady)(http.NotFoundHandler())
+
+	whitelisted := requestsTotal.WithLabelValues(outcomeAllowed, "whitelist")
+	notReady := requestsTotal.WithLabelValues(outcomeError, "not_ready")
+	before, beforeNotReady := testutil.ToFloat64(whitelisted), testutil.ToFloat64(notReady)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/public/index.html", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/app", nil))
+	if got := testutil.ToFloat64(whitelisted) - before; got != 1 {
+		t.Errorf("Wrong number of whitelisted requests. Got %v, expected 1", got)
+	}
+	if got := testutil.ToFloat64(notReady) - beforeNotReady; got != 1 {
+		t.Errorf("Wrong number of requests while not ready. Got %v, expected 1", got)
+	}
+
+	// The health server serves both the readiness probe and the metrics
+	health := healthHandler(isReady)
+	w := httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong readiness status. Got %d, expected 503", w.Code)
+	}
+	w = httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "authservice_requests_total") {
+		t.Errorf("Metrics don't include authservice_requests_total: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSessionCounter(t *testing.T) {
+	calls := 0
+	var err error
+	c := &sessionCounter{
+		count: func() (int, error) {
+			calls++
+			return calls, err
+		},
+		ttl: time.Minute,
+	}
+	if got := c.get(); got != 1 {
+		t.Fatalf("Got %v sessions, want 1", got)
+	}
+	// The count is cached
+	if got := c.get(); got != 1 || calls != 1 {
+		t.Fatalf("Got %v sessions after %d counts, want 1 after 1", got, calls)
+	}
+
+	// Failed counts keep the last count and are retried
+	c.countedAt = time.Now().Add(-2 * time.Minute)
+	err = errors.New("store is down")
+	if got := c.get(); got != 1 {
+		t.Errorf("Got %v sessions after a failed count, want 1", got)
+	}
+	err = nil
+	if got := c.get(); got != 3 || calls != 3 {
+		t.Errorf("Got %v sessions after %d counts, want 3 after 3", got, calls)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/securecookie"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// PKCE modes, see PKCE_MODE.
+// Proof Key for Code Exchange is described in RFC7636:
+// https://tools.ietf.org/html/rfc7636
+const (
+	pkceModeAuto     = "auto"
+	pkceModeRequired = "required"
+	pkceModeDisabled = "disabled"
+)
+
+const pkceMethodS256 = "S256"
+
+// newCodeVerifier returns a random code_verifier with 256 bits of entropy.
+func newCodeVerifier() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// codeChallengeS256 derives the S256 code_challenge of a code_verifier.
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// pkceAuthCodeOptions returns the parameters that add the code_challenge of
+// the given verifier to an authorization request.
+func pkceAuthCodeOptions(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", codeChallengeS256(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", pkceMethodS256),
+	}
+}
+
+// pkceSupported parses the OIDC Provider claims from the discovery document
+// and checks if the provider advertises support for the S256 method.
+func pkceSupported(p *oidc.Provider) (bool, error) {
+	claims := struct {
+		CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return false, errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	for _, method := range claims.CodeChallengeMethodsSupported {
+		if method == pkceMethodS256 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,157 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCodeChallengeS256(t *testing.T) {
+	// Example from https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	expected := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got := codeChallengeS256(verifier); got != expected {
+		t.Fatalf("Wrong code_challenge. Got %v, expected %v", got, expected)
+	}
+	if l := len(newCodeVerifier()); l < 43 || l > 128 {
+		t.Fatalf("code_verifier must be 43 to 128 characters long, got %d", l)
+	}
+}
+
+// newPKCETestServer returns a server with a single provider for the fake
+// provider, created with the given PKCE mode.
+func newPKCETestServer(t *testing.T, idp *testProvider, pkceMode string) *server {
+	p, err := newOIDCProvider(context.Background(), providerConfig{
+		Name:        defaultProviderName,
+		Issuer:      idp.URL,
+		ClientID:    "authservice",
+		UserIDClaim: "sub",
+	}, pkceMode)
+	if err != nil {
+		t.Fatalf("Unexpected error creating provider: %v", err)
+	}
+	backend := newMemoryStore()
+	return &server{
+		providers:            []*oidcProvider{p},
+		backend:              backend,
+		store:                newStoreAdapter(backend, 60, []byte("key")),
+		sessionMaxAgeSeconds: 60,
+		pkceRequired:         pkceMode == pkceModeRequired,
+	}
+}
+
+// completeLogin completes the login with the given state at the callback,
+// with an ID token for alice.
+func completeLogin(t *testing.T, s *server, idp *testProvider, id string, st *state) *httptest.ResponseRecorder {
+	idp.tokenResponse = map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token": idp.sign(t, map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   "authservice",
+			"sub":   "alice",
+			"nonce": st.nonce,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		}),
+	}
+	q := url.Values{"state": {id}, "code": {"code"}}
+	r := httptest.NewRequest("GET", "/login/oidc?"+q.Encode(), nil)
+	r.AddCookie(newStateCookie(id))
+	w := httptest.NewRecorder()
+	s.callback(w, r)
+	return w
+}
+
+func TestPKCELogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		methods  []string
+		wantPKCE bool
+	}{
+		{"auto, supported", pkceModeAuto, []string{"plain", "S256"}, true},
+		{"auto, only plain", pkceModeAuto, []string{"plain"}, false},
+		{"auto, not advertised", pkceModeAuto, nil, false},
+		{"required", pkceModeRequired, nil, true},
+		{"disabled", pkceModeDisabled, []string{"S256"}, false},
+	}
+	for _, test := range tests {
+		idp := newTestProvider(t)
+		idp.pkceMethods = test.methods
+		s := newPKCETestServer(t, idp, test.mode)
+
+		// The authorization request carries the challenge of the verifier
+		// stored in the login state
+		w := httptest.NewRecorder()
+		s.startLogin(w, httptest.NewRequest("GET", "/notebooks", nil), s.providers[0], "/notebooks")
+		if w.Code != http.StatusFound {
+			t.Fatalf("%s: got status %d, want %d", test.name, w.Code, http.StatusFound)
+		}
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("%s: Unexpected error parsing redirect: %v", test.name, err)
+		}
+		q := authURL.Query()
+		id := q.Get("state")
+		st, err := load(s.backend, id)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error loading state: %+v", test.name, err)
+		}
+		if test.wantPKCE {
+			if st.codeVerifier == "" {
+				t.Fatalf("%s: login state has no code_verifier", test.name)
+			}
+			if got, want := q.Get("code_challenge"), codeChallengeS256(st.codeVerifier); got != want {
+				t.Errorf("%s: got code_challenge %q, want %q", test.name, got, want)
+			}
+			if got := q.Get("code_challenge_method"); got != pkceMethodS256 {
+				t.Errorf("%s: got code_challenge_method %q, want %q", test.name, got, pkceMethodS256)
+			}
+		} else {
+			if st.codeVerifier != "" {
+				t.Errorf("%s: login state has a code_verifier", test.name)
+			}
+			if q.Get("code_challenge") != "" || q.Get("code_challenge_method") != "" {
+				t.Errorf("%s: authorization request has a code_challenge: %v", test.name, q)
+			}
+		}
+
+		// The code exchange proves the login with the stored verifier
+		if w := completeLogin(t, s, idp, id, st); w.Code != http.StatusFound {
+			t.Fatalf("%s: got status %d, want %d: %s", test.name, w.Code, http.StatusFound, w.Body)
+		}
+		if len(idp.tokenRequests) == 0 {
+			t.Fatalf("%s: code was not exchanged", test.name)
+		}
+		if got := idp.tokenRequests[0].Get("code_verifier"); got != st.codeVerifier {
+			t.Errorf("%s: got code_verifier %q, want %q", test.name, got, st.codeVerifier)
+		}
+	}
+}
+
+func TestPKCERequired(t *testing.T) {
+	idp := newTestProvider(t)
+	s := newPKCETestServer(t, idp, pkceModeRequired)
+
+	// e.g. a login started before PKCE was required
+	st := newState("/notebooks")
+	st.provider = defaultProviderName
+	id, err := st.save(s.backend)
+	if err != nil {
+		t.Fatalf("Unexpected error saving state: %+v", err)
+	}
+	if w := completeLogin(t, s, idp, id, st); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(idp.tokenRequests) != 0 {
+		t.Errorf("code was exchanged without a code_verifier: %v", idp.tokenRequests)
+	}
+	if recs, err := s.backend.ListBySubject("alice"); err != nil || len(recs) != 0 {
+		t.Errorf("session was created: %+v, %v", recs, err)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultProviderName is the name of the provider configured with the
+// OIDC_PROVIDER and CLIENT_* env variables.
+const defaultProviderName = "default"
+
+// providersConfig is the list of OIDC providers, read from
+// PROVIDERS_CONFIG_PATH.
+type providersConfig struct {
+	Providers []providerConfig `yaml:"providers"`
+}
+
+type providerConfig struct {
+	// Name identifies the provider in sessions and in the login chooser.
+	Name         string   `yaml:"name"`
+	Issuer       string   `yaml:"issuer"`
+	AuthURL      string   `yaml:"authURL"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	UserIDClaim  string   `yaml:"userIDClaim"`
+	// Introspection enables introspecting opaque bearer tokens at the
+	// provider's introspection_endpoint.
+	Introspection bool `yaml:"introspection"`
+	// UserInfo enables adding the claims of the UserInfo endpoint to the
+	// claims of the ID token.
+	UserInfo bool `yaml:"userInfo"`
+	// Hosts and PathPrefix select the requests that use the provider.
+	// A leading "*." in a host matches any subdomain.
+	Hosts      []string `yaml:"hosts"`
+	PathPrefix string   `yaml:"pathPrefix"`
+}
+
+func loadProvidersConfig(path string) ([]providerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading providers config")
+	}
+	return parseProvidersConfig(data)
+}
+
+func parseProvidersConfig(data []byte) ([]providerConfig, error) {
+	config := providersConfig{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, errors.Wrap(err, "error parsing providers config")
+	}
+	if len(config.Providers) == 0 {
+		return nil, errors.New("no providers configured")
+	}
+	names := map[string]bool{}
+	for _, p := range config.Providers {
+		if p.Name == "" {
+			return nil, errors.New("provider doesn't have a name")
+		}
+		if names[p.Name] {
+			return nil, errors.Errorf("duplicate provider %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, errors.Errorf("provider %q must have an issuer and a clientID", p.Name)
+		}
+	}
+	return config.Providers, nil
+}
+
+// oidcProvider is an OIDC provider that users can log in with.
+type oidcProvider struct {
+	name         string
+	issuer       string
+	provider     *oidc.Provider
+	oauth2Config *oauth2.Config
+	userIDClaim  string
+	// idTokenVerifier verifies the ID tokens of logins, bearer verifies
+	// bearer tokens issued to our client.
+	idTokenVerifier *oidc.IDTokenVerifier
+	bearer          *bearerIssuer
+	// introspectionEndpoint is set if opaque bearer tokens are
+	// introspected at the provider.
+	introspectionEndpoint string
+	// userInfo is true if the claims of sessions are completed with the
+	// UserInfo endpoint.
+	userInfo bool
+	// pkce is true if logins with this provider use PKCE.
+	pkce       bool
+	hosts      []string
+	pathPrefix string
+}
+
+// newOIDCProvider discovers the provider's endpoints. PKCE is used if the
+// mode is "required", or if it is "auto" and the provider supports it.
+func newOIDCProvider(ctx context.Context, c providerConfig, pkceMode string) (*oidcProvider, error) {
+	provider, err := oidc.NewProvider(ctx, c.Issuer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error discovering provider %q", c.Name)
+	}
+	issuer, err := providerIssuer(provider)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := provider.Endpoint()
+	if c.AuthURL != "" {
+		endpoint.AuthURL = c.AuthURL
+	}
+	p := &oidcProvider{
+		name:     c.Name,
+		issuer:   issuer,
+		provider: provider,
+		oauth2Config: &oauth2.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			Endpoint:     endpoint,
+			RedirectURL:  c.RedirectURL,
+			Scopes:       append(clean(c.Scopes), oidc.ScopeOpenID),
+		},
+		userIDClaim:     c.UserIDClaim,
+		idTokenVerifier: provider.Verifier(&oidc.Config{ClientID: c.ClientID}),
+		bearer: newBearerIssuer(provider, trustedIssuerConfig{
+			Issuer:      issuer,
+			Audiences:   []string{c.ClientID},
+			UserIDClaim: c.UserIDClaim,
+		}),
+		userInfo:   c.UserInfo,
+		pkce:       pkceMode == pkceModeRequired,
+		hosts:      c.Hosts,
+		pathPrefix: c.PathPrefix,
+	}
+	if c.Introspection {
+		if p.introspectionEndpoint, err = introspectionEndpoint(provider); err != nil {
+			log.Warnf("Token introspection disabled for provider %q: %v", c.Name, err)
+		}
+	}
+	if pkceMode == pkceModeAuto {
+		if p.pkce, err = pkceSupported(provider); err != nil {
+			log.Warnf("Couldn't check if provider %q supports PKCE: %v", c.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// providerIssuer returns the issuer of the provider from its discovery
+// document.
+func providerIssuer(p *oidc.Provider) (string, error) {
+	claims := struct {
+		Issuer string `json:"issuer"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	return claims.Issuer, nil
+}
+
+// verifier returns the verifier for ID tokens issued to us by the provider.
+func (p *oidcProvider) verifier() *oidc.IDTokenVerifier {
+	return p.idTokenVerifier
+}
+
+// hasSelectors returns true if the provider only serves some requests.
+func (p *oidcProvider) hasSelectors() bool {
+	return len(p.hosts) > 0 || p.pathPrefix != ""
+}
+
+func (p *oidcProvider) matches(r *http.Request) bool {
+	if len(p.hosts) > 0 && !matchHost(p.hosts, r.Host) {
+		return false
+	}
+	return p.pathPrefix == "" || strings.HasPrefix(r.URL.Path, p.pathPrefix)
+}
+
+// providersFor returns the providers that may authenticate the request.
+// Providers whose hosts or path prefix match the request take precedence
+// over providers that serve all requests.
+func (s *server) providersFor(r *http.Request) []*oidcProvider {
+	selected := []*oidcProvider{}
+	for _, p := range s.providers {
+		if p.hasSelectors() && p.matches(r) {
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) > 0 {
+		return selected
+	}
+	for _, p := range s.providers {
+		if !p.hasSelectors() {
+			selected = append(selected, p)
+		}
+	}
+	return selected
+}
+
+// providerByName returns the provider with the given name, or nil.
+// Sessions created before multiple providers were supported have no provider
+// name and belong to the first provider.
+func (s *server) providerByName(name string) *oidcProvider {
+	if name == "" && len(s.providers) > 0 {
+		return s.providers[0]
+	}
+	for _, p := range s.providers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// providerByIssuer returns the provider with the given issuer from the given
+// providers, or nil.
+func providerByIssuer(providers []*oidcProvider, issuer string) *oidcProvider {
+	for _, p := range providers {
+		if p.issuer == issuer {
+			return p
+		}
+	}
+	return nil
+}
+
+// sessionProvider returns the provider that issued the session, or nil if it
+// is no longer configured.
+func (s *server) sessionProvider(session *sessions.Session) *oidcProvider {
+	name, _ := session.Values[userSessionProvider].(string)
+	return s.providerByName(name)
+}
+
+// recordProvider returns the provider that issued a stored session, or nil if
+// it is no longer configured.
+func (s *server) recordProvider(rec *sessionRecord) *oidcProvider {
+	name, _ := rec.Values[userSessionProvider].(string)
+	return s.providerByName(name)
+}
+
+// unverifiedIssuer returns the iss claim of a JWT without verifying it, to
+// find the provider that can verify it.
+func unverifiedIssuer(rawToken string) (string, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "invalid JWT payload")
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.Wrap(err, "invalid JWT payload")
+	}
+	return claims.Issuer, nil
+}
+
+var loginChooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html><head><title>Log in</title></head>
+<body>
+<h1>Log in with</h1>
+<ul>
+{{range .}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body></html>
+`))
+
+// loginChooser lets the user pick the provider to log in with, when more
+// than one provider may authenticate the request.
+// The page is returned with 401, so that it is shown to the user in Envoy
+// ext_authz mode instead of allowing the request.
+func (s *server) loginChooser(w http.ResponseWriter, r *http.Request, providers []*oidcProvider) {
+	type choice struct{ Name, URL string }
+	choices := []choice{}
+	for _, p := range providers {
+		q := url.Values{"provider": {p.name}, "rd": {r.URL.String()}}
+		choices = append(choices, choice{Name: p.name, URL: "/login/start?" + q.Encode()})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := loginChooserTemplate.Execute(w, choices); err != nil {
+		loggerForRequest(r).Errorf("Error rendering login chooser: %v", err)
+	}
+}
+
+// loginStart starts a login with the provider picked in the login chooser.
+func (s *server) loginStart(w http.ResponseWriter, r *http.Request) {
+	logger := loggerForRequest(r)
+	p := s.providerByName(r.URL.Query().Get("provider"))
+	if p == nil || r.URL.Query().Get("provider") == "" {
+		logger.Errorf("Unknown provider %q", r.URL.Query().Get("provider"))
+		returnStatus(w, http.StatusBadRequest, "Unknown provider.")
+		return
+	}
+	// Only redirect to local paths after the login, to avoid open redirects
+	rd := r.URL.Query().Get("rd")
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") || strings.HasPrefix(rd, "/\\") {
+		rd = "/"
+	}
+	s.startLogin(w, r, p, rd)
+}
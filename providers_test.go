@@ -0,0 +1,131 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseProvidersConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"valid", `
+providers:
+- name: corp
+  issuer: https://corp.example.com
+  clientID: authservice
+  hosts: ["*.corp.example.com"]
+- name: partners
+  issuer: https://partners.example.com
+  clientID: authservice
+`, false},
+		{"no providers", "providers: []\n", true},
+		{"missing name", "providers:\n- issuer: https://a\n  clientID: c\n", true},
+		{"missing issuer", "providers:\n- name: a\n  clientID: c\n", true},
+		{"duplicate name", "providers:\n- {name: a, issuer: https://a, clientID: c}\n- {name: a, issuer: https://b, clientID: c}\n", true},
+		{"unknown field", "providers:\n- {name: a, issuer: https://a, clientID: c, client: d}\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseProvidersConfig([]byte(test.config))
+			if (err != nil) != test.err {
+				t.Errorf("Got error %v, want error: %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestProvidersFor(t *testing.T) {
+	corp := &oidcProvider{name: "corp", hosts: []string{"*.corp.example.com"}}
+	admin := &oidcProvider{name: "admin", pathPrefix: "/admin"}
+	a := &oidcProvider{name: "a"}
+	b := &oidcProvider{name: "b"}
+	s := &server{providers: []*oidcProvider{corp, admin, a, b}}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"https://ml.corp.example.com/", []string{"corp"}},
+		{"https://example.com/admin/users", []string{"admin"}},
+		{"https://ml.corp.example.com/admin", []string{"corp", "admin"}},
+		{"https://example.com/", []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			got := []string{}
+			for _, p := range s.providersFor(httptest.NewRequest("GET", test.url, nil)) {
+				got = append(got, p.name)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("Got providers %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoginChooser(t *testing.T) {
+	backend := newMemoryStore()
+	s := &server{
+		providers: []*oidcProvider{
+			newTestProvider(t).provider(t, "corp"),
+			newTestProvider(t).provider(t, "partners"),
+		},
+		backend: backend,
+		store:   newStoreAdapter(backend, 60, []byte("key")),
+	}
+
+	// Without a session, the user picks a provider
+	w := httptest.NewRecorder()
+	s.authenticate(w, httptest.NewRequest("GET", "/notebooks", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	for _, name := range []string{"corp", "partners"} {
+		link := "/login/start?" + url.Values{"provider": {name}, "rd": {"/notebooks"}}.Encode()
+		if !strings.Contains(w.Body.String(), strings.Replace(link, "&", "&amp;", -1)) {
+			t.Errorf("Login chooser doesn't link to %q: %s", link, w.Body.String())
+		}
+	}
+
+	start := func(query url.Values) (*httptest.ResponseRecorder, *state) {
+		w := httptest.NewRecorder()
+		s.loginStart(w, httptest.NewRequest("GET", "/login/start?"+query.Encode(), nil))
+		if w.Code != http.StatusFound {
+			return w, nil
+		}
+		cookie := w.Result().Cookies()[0]
+		st, err := load(backend, cookie.Value)
+		if err != nil {
+			t.Fatalf("Unexpected error loading state: %+v", err)
+		}
+		return w, st
+	}
+
+	w, st := start(url.Values{"provider": {"partners"}, "rd": {"/notebooks"}})
+	if st == nil {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusFound)
+	}
+	if st.provider != "partners" || st.origURL != "/notebooks" {
+		t.Errorf("Got state for provider %q and URL %q", st.provider, st.origURL)
+	}
+	if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, s.providers[1].issuer+"/auth?") {
+		t.Errorf("Login redirects to %q, want the partners provider", loc)
+	}
+
+	// Redirects after the login are limited to local paths
+	if _, st := start(url.Values{"provider": {"corp"}, "rd": {"//evil.com/"}}); st == nil || st.origURL != "/" {
+		t.Errorf("Login with external rd was not redirected to /: %+v", st)
+	}
+
+	if w, _ := start(url.Values{"provider": {"unknown"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for unknown provider, want %d", w.Code, http.StatusBadRequest)
+	}
+}
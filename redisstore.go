@@ -0,0 +1,250 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	redisKeyPrefix        = "authservice_session_"
+	redisUserKeyPrefix    = "authservice_user_"
+	redisSubjectKeyPrefix = "authservice_sub_"
+	redisSIDKeyPrefix     = "authservice_sid_"
+)
+
+// redisPutScript writes a record and adds it to its index sets.
+// Index sets live as long as their longest-lived record, so their TTL is only
+// ever extended. Records that moved to other index sets are removed from the
+// old ones, and stale members are pruned by listIndex.
+//
+// KEYS[1] is the record's key, followed by ARGV[4] index sets of the record
+// and then the index sets that it must be removed from. ARGV[1] is the
+// record, ARGV[2] its id and ARGV[3] its TTL in seconds.
+var redisPutScript = redis.NewScript(-1, `
+local ttl = tonumber(ARGV[3])
+local indexes = tonumber(ARGV[4])
+redis.call('SETEX', KEYS[1], ttl, ARGV[1])
+for i = 2, indexes + 1 do
+	redis.call('SADD', KEYS[i], ARGV[2])
+	if redis.call('TTL', KEYS[i]) < ttl then
+		redis.call('EXPIRE', KEYS[i], ttl)
+	end
+end
+for i = indexes + 2, #KEYS do
+	redis.call('SREM', KEYS[i], ARGV[2])
+end
+return 0
+`)
+
+// redisStore is a sessionStore that keeps records in Redis, so they are
+// shared between all authservice replicas that use the same Redis instance.
+// Expiry is handled by Redis itself, using key TTLs.
+// Each user, IdP subject and IdP session has a set with the ids of its
+// records, for ListByUser, ListBySubject and ListBySID.
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// newRedisPool returns a connection pool for the Redis server at addr.
+func newRedisPool(addr, password string, db int) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr,
+				redis.DialPassword(password),
+				redis.DialDatabase(db),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func newRedisStore(pool *redis.Pool) (*redisStore, error) {
+	// Fail early if Redis is unreachable
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, errors.Wrap(err, "error contacting redis")
+	}
+	return &redisStore{pool: pool}, nil
+}
+
+func (s *redisStore) Get(id string) (*sessionRecord, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", redisKeyPrefix+id))
+	if err == redis.ErrNil {
+		return nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading record from redis")
+	}
+	return decodeRecord(data)
+}
+
+func (s *redisStore) Put(rec *sessionRecord, ttl time.Duration) error {
+	rec.ExpiresAt = time.Now().Add(ttl)
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	// An update may change the user, subject or sid of the record
+	indexKeys := redisIndexKeys(rec)
+	staleKeys := []string{}
+	old, err := s.Get(rec.ID)
+	if err != nil && err != errRecordNotFound {
+		return err
+	}
+	if err == nil {
+		for _, key := range redisIndexKeys(old) {
+			if !containsAnyString(indexKeys, []string{key}) {
+				staleKeys = append(staleKeys, key)
+			}
+		}
+	}
+
+	keys := append(append([]string{redisKeyPrefix + rec.ID}, indexKeys...), staleKeys...)
+	args := []interface{}{len(keys)}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, data, rec.ID, seconds, len(indexKeys))
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := redisPutScript.Do(conn, args...); err != nil {
+		return errors.Wrap(err, "error writing record to redis")
+	}
+	return nil
+}
+
+func (s *redisStore) Delete(id string) error {
+	rec, err := s.Get(id)
+	if err == errRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", redisKeyPrefix+id)
+	for _, key := range redisIndexKeys(rec) {
+		conn.Send("SREM", key, id)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return errors.Wrap(err, "error deleting record from redis")
+	}
+	return nil
+}
+
+func (s *redisStore) List() ([]*sessionRecord, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	res := []*sessionRecord{}
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing records from redis")
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return nil, errors.Wrap(err, "error listing records from redis")
+		}
+		for _, key := range keys {
+			data, err := redis.Bytes(conn.Do("GET", key))
+			if err == redis.ErrNil {
+				// Expired since the scan
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "error reading record from redis")
+			}
+			rec, err := decodeRecord(data)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, rec)
+		}
+		if cursor == 0 {
+			return res, nil
+		}
+	}
+}
+
+// redisIndexKeys returns the keys of the index sets the record belongs to.
+func redisIndexKeys(rec *sessionRecord) []string {
+	keys := []string{}
+	if rec.UserID != "" {
+		keys = append(keys, redisUserKeyPrefix+rec.UserID)
+	}
+	if rec.Subject != "" {
+		keys = append(keys, redisSubjectKeyPrefix+rec.Subject)
+	}
+	if rec.SID != "" {
+		keys = append(keys, redisSIDKeyPrefix+rec.SID)
+	}
+	return keys
+}
+
+func (s *redisStore) ListByUser(userID string) ([]*sessionRecord, error) {
+	return s.listIndex(redisUserKeyPrefix + userID)
+}
+
+func (s *redisStore) ListBySubject(sub string) ([]*sessionRecord, error) {
+	return s.listIndex(redisSubjectKeyPrefix + sub)
+}
+
+func (s *redisStore) ListBySID(sid string) ([]*sessionRecord, error) {
+	return s.listIndex(redisSIDKeyPrefix + sid)
+}
+
+// listIndex returns the unexpired records in the given index set.
+func (s *redisStore) listIndex(indexKey string) ([]*sessionRecord, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", indexKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing records from redis")
+	}
+	res := []*sessionRecord{}
+	for _, id := range ids {
+		data, err := redis.Bytes(conn.Do("GET", redisKeyPrefix+id))
+		if err == redis.ErrNil {
+			// Record has expired, prune it from the set
+			if _, err := conn.Do("SREM", indexKey, id); err != nil {
+				return nil, errors.Wrap(err, "error pruning records from redis")
+			}
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading record from redis")
+		}
+		rec, err := decodeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
@@ -0,0 +1,104 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisStore(t *testing.T) (*redisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	store, err := newRedisStore(newRedisPool(mr.Addr(), "", 0))
+	if err != nil {
+		t.Fatalf("Unexpected error creating redis store: %+v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, mr
+}
+
+func TestRedisStoreExpiry(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	rec := &sessionRecord{ID: "a", Kind: recordKindSession, UserID: "alice", Subject: "sub", SID: "sid"}
+	if err := store.Put(rec, time.Minute); err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+	if ttl := mr.TTL(redisKeyPrefix + "a"); ttl != time.Minute {
+		t.Errorf("Got record TTL %v, want %v", ttl, time.Minute)
+	}
+	for _, key := range []string{redisUserKeyPrefix + "alice", redisSubjectKeyPrefix + "sub", redisSIDKeyPrefix + "sid"} {
+		if ttl := mr.TTL(key); ttl != time.Minute {
+			t.Errorf("Got TTL %v for %s, want %v", ttl, key, time.Minute)
+		}
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if _, err := store.Get("a"); err != errRecordNotFound {
+		t.Errorf("Expected errRecordNotFound for expired record, got %v", err)
+	}
+}
+
+func TestRedisStoreIndexPruning(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	short := &sessionRecord{ID: "short", Kind: recordKindSession, UserID: "alice"}
+	long := &sessionRecord{ID: "long", Kind: recordKindSession, UserID: "alice"}
+	// A shorter-lived record doesn't shorten the expiry of the index
+	if err := store.Put(long, time.Hour); err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+	if err := store.Put(short, time.Minute); err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+	if ttl := mr.TTL(redisUserKeyPrefix + "alice"); ttl != time.Hour {
+		t.Errorf("Got index TTL %v, want %v", ttl, time.Hour)
+	}
+
+	// The expired record is pruned from the index when listing it
+	mr.FastForward(2 * time.Minute)
+	list, err := store.ListByUser("alice")
+	if err != nil {
+		t.Fatalf("Unexpected error in ListByUser: %+v", err)
+	}
+	if len(list) != 1 || list[0].ID != "long" {
+		t.Fatalf("Wrong records for user: %+v", list)
+	}
+	members, err := mr.Members(redisUserKeyPrefix + "alice")
+	if err != nil || len(members) != 1 || members[0] != "long" {
+		t.Errorf("Expired record was not pruned from the index: %v, %v", members, err)
+	}
+
+	// Delete removes the record from its indexes
+	if err := store.Delete("long"); err != nil {
+		t.Fatalf("Unexpected error in Delete: %+v", err)
+	}
+	if mr.Exists(redisUserKeyPrefix + "alice") {
+		members, _ := mr.Members(redisUserKeyPrefix + "alice")
+		t.Errorf("Deleted record is still indexed: %v", members)
+	}
+}
+
+func TestRedisStoreReindex(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	rec := &sessionRecord{ID: "a", Kind: recordKindSession, UserID: "alice", Subject: "sub", SID: "sid"}
+	if err := store.Put(rec, time.Minute); err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+
+	// An update that changes the user moves the record to the new user's
+	// index, and keeps it in the unchanged ones
+	rec.UserID = "bob"
+	if err := store.Put(rec, time.Minute); err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+	if mr.Exists(redisUserKeyPrefix + "alice") {
+		members, _ := mr.Members(redisUserKeyPrefix + "alice")
+		t.Errorf("Record is still indexed under its old user: %v", members)
+	}
+	for _, key := range []string{redisUserKeyPrefix + "bob", redisSubjectKeyPrefix + "sub", redisSIDKeyPrefix + "sid"} {
+		if ok, err := mr.SIsMember(key, "a"); err != nil || !ok {
+			t.Errorf("Record is not indexed in %s: %v", key, err)
+		}
+	}
+}
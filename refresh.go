@@ -0,0 +1,230 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// errRefreshRejected is returned when the IdP refuses to refresh the session's
+// tokens, e.g. because the refresh token was revoked or has expired.
+var errRefreshRejected = errors.New("refresh token rejected by the provider")
+
+// needsRefresh returns true if the session's access token or ID token has
+// expired or will expire within the given leeway. Sessions whose ID token was
+// dropped by an earlier refresh are only refreshed for their access token, and
+// sessions without a refresh token are never refreshed.
+func needsRefresh(session *sessions.Session, leeway time.Duration) bool {
+	deadline := time.Now().Add(leeway)
+	token, ok := session.Values[userSessionOAuth2Tokens].(oauth2.Token)
+	if !ok || token.RefreshToken == "" {
+		return false
+	}
+	if !token.Expiry.IsZero() && token.Expiry.Before(deadline) {
+		return true
+	}
+	if idToken, _ := session.Values[userSessionIDToken].(string); idToken == "" {
+		return false
+	}
+	return idTokenExpiring(session, deadline)
+}
+
+// idTokenExpiring returns true if the exp claim of the session's ID token is
+// before the deadline.
+func idTokenExpiring(session *sessions.Session, deadline time.Time) bool {
+	claims, ok := session.Values[userSessionClaims].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	// JSON numbers are decoded as float64
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0).Before(deadline)
+	}
+	return false
+}
+
+// refreshRejected returns true if the error of a refresh is the provider
+// refusing to refresh the tokens (e.g. invalid_grant), rather than a failure
+// that may go away on retry, like a 5xx response or rate limiting.
+func refreshRejected(err error) bool {
+	e, ok := err.(*oauth2.RetrieveError)
+	if !ok || e.Response == nil {
+		return false
+	}
+	code := e.Response.StatusCode
+	return code >= 400 && code < 500 && code != http.StatusTooManyRequests
+}
+
+// refreshSessionTokens uses the session's refresh token to get new tokens from
+// the provider. The new ID token (if one is returned) is verified and its
+// claims replace the ones in the session. If the provider doesn't return a new
+// ID token and the current one is expiring, it is dropped from the session,
+// so that it isn't forwarded after it expires and doesn't trigger a refresh on
+// every request. The session is modified in place, the caller is responsible
+// for saving it.
+func (s *server) refreshSessionTokens(ctx context.Context, session *sessions.Session) (err error) {
+	ctx, span := startSpan(ctx, "oauth2.Refresh")
+	defer func() { endSpan(span, err) }()
+
+	token, ok := session.Values[userSessionOAuth2Tokens].(oauth2.Token)
+	if !ok || token.RefreshToken == "" {
+		return errors.New("session doesn't have a refresh token")
+	}
+
+	p := s.sessionProvider(session)
+	if p == nil {
+		return errors.New("the provider of the session is no longer configured")
+	}
+
+	// Only pass the refresh token, so that the token source always refreshes
+	ts := p.oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken})
+	newToken, err := ts.Token()
+	if err != nil {
+		if refreshRejected(err) {
+			return errors.Wrap(errRefreshRejected, err.Error())
+		}
+		return errors.Wrap(err, "error refreshing tokens")
+	}
+	// Providers may not rotate the refresh token
+	if newToken.RefreshToken == "" {
+		newToken.RefreshToken = token.RefreshToken
+	}
+
+	// Providers may not return a new ID token on refresh
+	claims, _ := session.Values[userSessionClaims].(map[string]interface{})
+	rawIDToken, newIDToken := newToken.Extra("id_token").(string)
+	if newIDToken {
+		idToken, err := p.verifier().Verify(ctx, rawIDToken)
+		if err != nil {
+			return errors.Wrap(err, "unable to verify refreshed ID token")
+		}
+		newClaims := map[string]interface{}{}
+		if err := idToken.Claims(&newClaims); err != nil {
+			return errors.Wrap(err, "unable to get refreshed ID token claims")
+		}
+		// The refreshed ID token must be about the same user
+		// See: https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokenResponse
+		if claims["sub"] != newClaims["sub"] {
+			return errors.Errorf("refreshed ID token has different subject: got %v, expected %v",
+				newClaims["sub"], claims["sub"])
+		}
+		claims = newClaims
+	}
+	// Re-fetch the UserInfo claims, which may have changed too
+	if p.userInfo {
+		sub, _ := claims["sub"].(string)
+		userInfo, err := fetchUserInfo(ctx, p, newToken, sub)
+		if err != nil {
+			return errors.Wrap(err, "unable to get refreshed userinfo claims")
+		}
+		claims = mergeUserInfo(claims, userInfo)
+	}
+
+	if newIDToken || p.userInfo {
+		session.Values[userSessionClaims] = claims
+	}
+	if newIDToken {
+		session.Values[userSessionIDToken] = rawIDToken
+	} else if idTokenExpiring(session, time.Now().Add(s.tokenRefreshLeeway)) {
+		session.Values[userSessionIDToken] = ""
+	}
+	session.Values[userSessionOAuth2Tokens] = *newToken
+	// Exchange the new access token, so that upstream tokens aren't based on
+	// stale claims
+	delete(session.Values, userSessionExchangedTokens)
+	return nil
+}
+
+// refreshSession refreshes the session's tokens and saves it. If the provider
+// rejects the refresh, the session is deleted and errRefreshRejected is
+// returned.
+//
+// Parallel requests of the same browser all find that the session needs a
+// refresh. Providers that rotate refresh tokens reject all but the first
+// refresh with the same refresh token, so refreshes of the same session are
+// done once at a time, and the session is re-read from the store before
+// refreshing it, or ending it, in case another replica already refreshed it.
+func (s *server) refreshSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	values, err, _ := s.sessionRefreshes.Do(session.ID, func() (interface{}, error) {
+		if err := s.refreshStoredSession(w, r, session); err != nil {
+			return nil, err
+		}
+		return copySessionValues(session.Values), nil
+	})
+	if err != nil {
+		return err
+	}
+	session.Values = copySessionValues(values.(map[interface{}]interface{}))
+	return nil
+}
+
+func (s *server) refreshStoredSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	logger := loggerForRequest(r)
+	if err := s.reloadSession(session); err != nil {
+		return err
+	}
+	if !needsRefresh(session, s.tokenRefreshLeeway) {
+		logger.Info("User session was already refreshed")
+		return nil
+	}
+	used, _ := session.Values[userSessionOAuth2Tokens].(oauth2.Token)
+
+	ctx := setTLSContext(r.Context(), s.caBundle)
+	err := s.refreshSessionTokens(ctx, session)
+	if errors.Cause(err) == errRefreshRejected {
+		// The refresh token was rotated by a refresh of another replica
+		if reloadErr := s.reloadSession(session); reloadErr == nil {
+			if current, _ := session.Values[userSessionOAuth2Tokens].(oauth2.Token); current.RefreshToken != used.RefreshToken {
+				logger.Info("User session was refreshed by another replica")
+				return nil
+			}
+		}
+		logger.Infof("Ending user session, token refresh failed: %v", err)
+		session.Options.MaxAge = -1
+		if err := session.Save(r, w); err != nil {
+			logger.Errorf("Couldn't delete user session: %v", err)
+		}
+		s.audit.log(r, sessionAuditEvent(auditSessionEnded, session, "refresh_rejected"))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := session.Save(r, w); err != nil {
+		logger.Errorf("Couldn't save refreshed user session: %v", err)
+	} else {
+		logger.Info("Refreshed tokens of user session")
+		s.audit.log(r, sessionAuditEvent(auditSessionRefreshed, session, ""))
+	}
+	return nil
+}
+
+// reloadSession replaces the session's values with the ones in the store.
+func (s *server) reloadSession(session *sessions.Session) error {
+	if s.backend == nil {
+		return nil
+	}
+	rec, err := s.backend.Get(session.ID)
+	if err == errRecordNotFound {
+		return errors.Wrap(errRefreshRejected, "session no longer exists")
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reloading user session")
+	}
+	session.Values = rec.Values
+	return nil
+}
+
+func copySessionValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	res := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,236 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+func TestNeedsRefresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		expiry   time.Time
+		idExpiry time.Time
+		expected bool
+	}{
+		{"valid", now.Add(time.Hour), now.Add(time.Hour), false},
+		{"access token expired", now.Add(-time.Minute), now.Add(time.Hour), true},
+		{"access token expiring", now.Add(30 * time.Second), now.Add(time.Hour), true},
+		{"id token expiring", now.Add(time.Hour), now.Add(30 * time.Second), true},
+		{"access token without expiry", time.Time{}, now.Add(time.Hour), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := sessions.NewSession(nil, userSessionCookie)
+			session.Values[userSessionOAuth2Tokens] = oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: test.expiry}
+			session.Values[userSessionIDToken] = "idtoken"
+			session.Values[userSessionClaims] = map[string]interface{}{
+				"exp": float64(test.idExpiry.Unix()),
+			}
+			if got := needsRefresh(session, time.Minute); got != test.expected {
+				t.Fatalf("Got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+
+	// An ID token dropped by an earlier refresh doesn't need a refresh
+	session := sessions.NewSession(nil, userSessionCookie)
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: now.Add(time.Hour)}
+	session.Values[userSessionIDToken] = ""
+	session.Values[userSessionClaims] = map[string]interface{}{"exp": float64(now.Unix())}
+	if needsRefresh(session, time.Minute) {
+		t.Error("Session with a dropped ID token needs a refresh")
+	}
+
+	// Sessions without a refresh token can't be refreshed
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{AccessToken: "a", Expiry: now}
+	if needsRefresh(session, time.Minute) {
+		t.Error("Session without a refresh token needs a refresh")
+	}
+}
+
+func TestRefreshWithoutIDToken(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	backend := newMemoryStore()
+	s := &server{
+		providers:          []*oidcProvider{p},
+		backend:            backend,
+		store:              newStoreAdapter(backend, 60, []byte("key")),
+		tokenRefreshLeeway: time.Minute,
+	}
+	s.userIDOpts.header = defaultUserIDHeader
+	s.userIDOpts.tokenHeader = defaultUserIDTokenHeader
+
+	// The ID token is expiring, the access token isn't
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice@example.com"
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice", "exp": float64(time.Now().Unix())}
+	session.Values[userSessionIDToken] = "idtoken"
+	session.Values[userSessionProvider] = p.name
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	cookie := login.Result().Cookies()[0]
+
+	// The provider doesn't return a new ID token
+	idp.tokenResponse = map[string]interface{}{"access_token": "new", "token_type": "Bearer", "expires_in": 3600}
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(defaultUserIDTokenHeader); got != "" {
+			t.Errorf("Expired ID token was forwarded: %q", got)
+		}
+	}
+	if len(idp.tokenRequests) != 1 {
+		t.Errorf("Got %d token requests, want 1", len(idp.tokenRequests))
+	}
+}
+
+func TestRefreshConcurrent(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	backend := newMemoryStore()
+	s := &server{
+		providers:          []*oidcProvider{p},
+		backend:            backend,
+		store:              newStoreAdapter(backend, 60, []byte("key")),
+		tokenRefreshLeeway: time.Minute,
+	}
+
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice@example.com"
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice"}
+	session.Values[userSessionIDToken] = ""
+	session.Values[userSessionProvider] = p.name
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Now(),
+	}
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	cookie := login.Result().Cookies()[0]
+
+	// The provider rotates the refresh token, so only one refresh with the
+	// old refresh token may happen
+	idp.tokenResponse = map[string]interface{}{
+		"access_token":  "new",
+		"refresh_token": "rotated",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	}
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			s.authenticate(w, r)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Got status %d, want %d", code, http.StatusOK)
+		}
+	}
+	if len(idp.tokenRequests) != 1 {
+		t.Errorf("Got %d token requests, want 1", len(idp.tokenRequests))
+	}
+	rec, err := backend.Get(session.ID)
+	if err != nil {
+		t.Fatalf("Session was deleted: %v", err)
+	}
+	if token := rec.Values[userSessionOAuth2Tokens].(oauth2.Token); token.RefreshToken != "rotated" {
+		t.Errorf("Got refresh token %q, want the rotated one", token.RefreshToken)
+	}
+}
+
+func TestRefreshProviderErrors(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	backend := newMemoryStore()
+	s := &server{
+		providers:          []*oidcProvider{p},
+		backend:            backend,
+		store:              newStoreAdapter(backend, 60, []byte("key")),
+		tokenRefreshLeeway: time.Minute,
+	}
+	s.userIDOpts.header = defaultUserIDHeader
+
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice@example.com"
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice"}
+	session.Values[userSessionIDToken] = ""
+	session.Values[userSessionProvider] = p.name
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Now(),
+	}
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	cookie := login.Result().Cookies()[0]
+	authenticate := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		return w
+	}
+
+	// Provider failures keep the session, the refresh is retried on the
+	// next request
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusTooManyRequests} {
+		idp.tokenStatus = status
+		idp.tokenResponse = map[string]interface{}{"error": "temporarily_unavailable"}
+		if w := authenticate(); w.Code != http.StatusOK {
+			t.Errorf("Got status %d after a %d from the provider, want %d", w.Code, status, http.StatusOK)
+		}
+		if _, err := backend.Get(session.ID); err != nil {
+			t.Fatalf("Session was deleted after a %d from the provider: %v", status, err)
+		}
+	}
+	// oauth2 may retry each refresh with another client authentication
+	if len(idp.tokenRequests) < 3 {
+		t.Errorf("Got %d token requests, want a refresh on each request", len(idp.tokenRequests))
+	}
+
+	// A rejected refresh token ends the session
+	idp.tokenStatus = http.StatusBadRequest
+	idp.tokenResponse = map[string]interface{}{"error": "invalid_grant"}
+	if w := authenticate(); w.Code == http.StatusOK {
+		t.Error("Request with a rejected refresh token was allowed")
+	}
+	if _, err := backend.Get(session.ID); err != errRecordNotFound {
+		t.Errorf("Expected the session to be deleted, got %v", err)
+	}
+}
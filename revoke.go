@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -37,7 +38,7 @@ func revokeTokens(ctx context.Context, revocationEndpoint string, token *oauth2.
 		}
 	}
 	if token.RefreshToken != "" {
-		err := revokeToken(ctx, revocationEndpoint, token.AccessToken, "refresh_token", clientID, clientSecret)
+		err := revokeToken(ctx, revocationEndpoint, token.RefreshToken, "refresh_token", clientID, clientSecret)
 		if err != nil {
 			return errors.Wrap(err, "Failed to revoke refresh token")
 		}
@@ -51,6 +52,7 @@ func revokeTokens(ctx context.Context, revocationEndpoint string, token *oauth2.
 func revokeToken(ctx context.Context, revocationEndpoint string, token, tokenType, clientID, clientSecret string) error {
 	// Verify revocation_endpoint has https url
 	if !strings.HasPrefix(revocationEndpoint, "https") {
+		tokenRevocationErrorsTotal.WithLabelValues(tokenType, "insecure_endpoint").Inc()
 		return errors.New(fmt.Sprintf("Revocation endpoint (%v) MUST use https", revocationEndpoint))
 	}
 	values := url.Values{}
@@ -63,13 +65,15 @@ func revokeToken(ctx context.Context, revocationEndpoint string, token, tokenTyp
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	// We only support basic auth now, we may need to support other methods in the future
 	// See: https://github.com/golang/oauth2/blob/bf48bf16ab8d622ce64ec6ce98d2c98f916b6303/internal/token.go#L204-L215
-	req.SetBasicAuth(clientID, clientSecret)
+	setClientBasicAuth(req, clientID, clientSecret)
 
 	resp, err := doRequest(ctx, req)
 	if err != nil {
+		tokenRevocationErrorsTotal.WithLabelValues(tokenType, "request_failed").Inc()
 		return errors.Wrap(err, "Error contacting revocation endpoint")
 	}
 	if code := resp.StatusCode; code != 200 {
+		tokenRevocationErrorsTotal.WithLabelValues(tokenType, "status_"+strconv.Itoa(code)).Inc()
 		// Read body to include in error for debugging purposes.
 		// According to RFC6749 (https://tools.ietf.org/html/rfc6749#section-5.2)
 		// the body should be in JSON, if we want to parse it in the future.
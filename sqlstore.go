@@ -0,0 +1,326 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqlSessionsTable   = "authservice_sessions"
+	sqlMigrationsTable = "authservice_schema_migrations"
+)
+
+// sqlDialect holds the differences between the SQL databases we support.
+type sqlDialect struct {
+	driver   string
+	blobType string
+	// lockStmt, if set, is executed at the start of the migration
+	// transaction so that replicas don't migrate concurrently.
+	lockStmt string
+}
+
+var (
+	postgresDialect = sqlDialect{
+		driver:   "postgres",
+		blobType: "BYTEA",
+		lockStmt: "SELECT pg_advisory_xact_lock(7431601232)",
+	}
+	sqliteDialect = sqlDialect{
+		driver:   "sqlite",
+		blobType: "BLOB",
+	}
+)
+
+// sqlMigration is a versioned change of the SQL store's schema. Its
+// statements are executed first, then convert, if set, rewrites the existing
+// rows in the same transaction.
+type sqlMigration struct {
+	stmts   func(d sqlDialect) []string
+	convert func(tx *sql.Tx) error
+}
+
+// sqlMigrations are the versioned schema changes of the SQL store.
+// Migrations are applied in order and each one exactly once. Never edit an
+// existing migration, append a new one instead.
+var sqlMigrations = []sqlMigration{
+	// 1: Sessions table, with an index on the expiry column for the sweeper.
+	{stmts: func(d sqlDialect) []string {
+		return []string{
+			fmt.Sprintf(`CREATE TABLE %s (
+				id VARCHAR(128) PRIMARY KEY,
+				data %s NOT NULL,
+				created_at BIGINT NOT NULL,
+				expires_at BIGINT NOT NULL
+			)`, sqlSessionsTable, d.blobType),
+			fmt.Sprintf("CREATE INDEX %[1]s_expires_at_idx ON %[1]s (expires_at)", sqlSessionsTable),
+		}
+	}},
+	// 2: Rows hold whole records instead of session values, with an
+	// indexed user_id column for listing the sessions of a user.
+	// Existing rows are converted to records.
+	{stmts: func(d sqlDialect) []string {
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN user_id VARCHAR(255) NOT NULL DEFAULT ''", sqlSessionsTable),
+			fmt.Sprintf("CREATE INDEX %[1]s_user_id_idx ON %[1]s (user_id)", sqlSessionsTable),
+		}
+	}, convert: convertSQLSessionValues},
+	// 3: Indexed subject and sid columns, for finding the sessions that a
+	// back-channel logout refers to.
+	{stmts: func(d sqlDialect) []string {
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN subject VARCHAR(255) NOT NULL DEFAULT ''", sqlSessionsTable),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN sid VARCHAR(255) NOT NULL DEFAULT ''", sqlSessionsTable),
+			fmt.Sprintf("CREATE INDEX %[1]s_subject_idx ON %[1]s (subject)", sqlSessionsTable),
+			fmt.Sprintf("CREATE INDEX %[1]s_sid_idx ON %[1]s (sid)", sqlSessionsTable),
+		}
+	}},
+}
+
+// convertSQLSessionValues converts the rows that hold gob-encoded session
+// values to session records, so that users stay logged in across the
+// upgrade. Rows that can't be decoded are dropped.
+func convertSQLSessionValues(tx *sql.Tx) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, data, created_at, expires_at FROM %s", sqlSessionsTable))
+	if err != nil {
+		return errors.Wrap(err, "error reading sessions")
+	}
+	records := []*sessionRecord{}
+	invalid := []string{}
+	for rows.Next() {
+		var id string
+		var data []byte
+		var createdAt, expiresAt int64
+		if err := rows.Scan(&id, &data, &createdAt, &expiresAt); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error reading sessions")
+		}
+		values := map[interface{}]interface{}{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+			log.Warnf("Dropping session that can't be decoded: %v", err)
+			invalid = append(invalid, id)
+			continue
+		}
+		rec := &sessionRecord{
+			ID:        id,
+			Kind:      recordKindSession,
+			Values:    values,
+			CreatedAt: time.Unix(createdAt, 0),
+			ExpiresAt: time.Unix(expiresAt, 0),
+		}
+		rec.UserID, _ = values[userSessionUserID].(string)
+		records = append(records, rec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error reading sessions")
+	}
+
+	// Statements can't be executed while the rows of a query are read
+	for _, rec := range records {
+		data, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET data = $1, user_id = $2 WHERE id = $3", sqlSessionsTable),
+			data, rec.UserID, rec.ID)
+		if err != nil {
+			return errors.Wrap(err, "error converting session")
+		}
+	}
+	for _, id := range invalid {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", sqlSessionsTable), id); err != nil {
+			return errors.Wrap(err, "error deleting session")
+		}
+	}
+	return nil
+}
+
+// sqlStore is a sessionStore that keeps records in a SQL database
+// (PostgreSQL or SQLite). Expired rows are ignored on read and periodically
+// removed by the sweeper.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// newSQLStore opens the database for the given dialect and data source and
+// migrates it to the latest schema.
+func newSQLStore(dialect sqlDialect, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening %s database", dialect.driver)
+	}
+	if dialect == sqliteDialect {
+		// SQLite only supports one writer at a time.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "error contacting %s database", dialect.driver)
+	}
+	if err := migrateSQLStore(db, dialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+// migrateSQLStore brings the database schema up to the latest version.
+func migrateSQLStore(db *sql.DB, dialect sqlDialect) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "error starting migration transaction")
+	}
+	defer tx.Rollback()
+
+	if dialect.lockStmt != "" {
+		if _, err := tx.Exec(dialect.lockStmt); err != nil {
+			return errors.Wrap(err, "error locking database for migration")
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`, sqlMigrationsTable))
+	if err != nil {
+		return errors.Wrap(err, "error creating migrations table")
+	}
+	var current int
+	row := tx.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", sqlMigrationsTable))
+	if err := row.Scan(&current); err != nil {
+		return errors.Wrap(err, "error reading schema version")
+	}
+
+	for i := current; i < len(sqlMigrations); i++ {
+		version := i + 1
+		migration := sqlMigrations[i]
+		for _, stmt := range migration.stmts(dialect) {
+			if _, err := tx.Exec(stmt); err != nil {
+				return errors.Wrapf(err, "error applying migration %d", version)
+			}
+		}
+		if migration.convert != nil {
+			if err := migration.convert(tx); err != nil {
+				return errors.Wrapf(err, "error applying migration %d", version)
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (version, applied_at) VALUES ($1, $2)", sqlMigrationsTable),
+			version, time.Now().Unix())
+		if err != nil {
+			return errors.Wrapf(err, "error recording migration %d", version)
+		}
+		log.Infof("Applied SQL store migration %d", version)
+	}
+	return errors.Wrap(tx.Commit(), "error committing migrations")
+}
+
+func (s *sqlStore) Get(id string) (*sessionRecord, error) {
+	var data []byte
+	row := s.db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE id = $1 AND expires_at > $2", sqlSessionsTable),
+		id, time.Now().Unix())
+	err := row.Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading record from database")
+	}
+	return decodeRecord(data)
+}
+
+func (s *sqlStore) Put(rec *sessionRecord, ttl time.Duration) error {
+	rec.ExpiresAt = time.Now().Add(ttl)
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf(`INSERT INTO %s (id, user_id, subject, sid, data, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, subject = excluded.subject, sid = excluded.sid,
+		data = excluded.data, expires_at = excluded.expires_at`, sqlSessionsTable),
+		rec.ID, rec.UserID, rec.Subject, rec.SID, data, rec.CreatedAt.Unix(), rec.ExpiresAt.Unix())
+	if err != nil {
+		return errors.Wrap(err, "error writing record to database")
+	}
+	return nil
+}
+
+func (s *sqlStore) Delete(id string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", sqlSessionsTable), id)
+	if err != nil {
+		return errors.Wrap(err, "error deleting record from database")
+	}
+	return nil
+}
+
+func (s *sqlStore) List() ([]*sessionRecord, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT data FROM %s WHERE expires_at > $1", sqlSessionsTable),
+		time.Now().Unix())
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing records from database")
+	}
+	return scanRecords(rows)
+}
+
+func (s *sqlStore) ListByUser(userID string) ([]*sessionRecord, error) {
+	return s.listBy("user_id", userID)
+}
+
+func (s *sqlStore) ListBySubject(sub string) ([]*sessionRecord, error) {
+	return s.listBy("subject", sub)
+}
+
+func (s *sqlStore) ListBySID(sid string) ([]*sessionRecord, error) {
+	return s.listBy("sid", sid)
+}
+
+// listBy returns the unexpired records whose indexed column has the given
+// value.
+func (s *sqlStore) listBy(column, value string) ([]*sessionRecord, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT data FROM %s WHERE %s = $1 AND expires_at > $2", sqlSessionsTable, column),
+		value, time.Now().Unix())
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing records from database")
+	}
+	return scanRecords(rows)
+}
+
+// scanRecords decodes the records of the data column of rows.
+func scanRecords(rows *sql.Rows) ([]*sessionRecord, error) {
+	defer rows.Close()
+	res := []*sessionRecord{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, errors.Wrap(err, "error reading record from database")
+		}
+		rec, err := decodeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, errors.Wrap(rows.Err(), "error listing records from database")
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) sweep() (int, error) {
+	res, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE expires_at <= $1", sqlSessionsTable), time.Now().Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting expired records")
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,120 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSQLDatabases returns the data sources of the SQL databases that can be
+// used in the test environment, keyed by store type. PostgreSQL is only
+// tested if POSTGRES_DSN is set. Its database must be dedicated to tests, as
+// the authservice tables are dropped first.
+func testSQLDatabases(t *testing.T) map[string]string {
+	dir, err := ioutil.TempDir("", "authservice-sqlstore")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dsns := map[string]string{storeTypeSQLite: filepath.Join(dir, "sessions.db")}
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn != "" {
+		db, err := sql.Open(postgresDialect.driver, dsn)
+		if err != nil {
+			t.Fatalf("Unexpected error opening postgres database: %v", err)
+		}
+		defer db.Close()
+		for _, table := range []string{sqlSessionsTable, sqlMigrationsTable} {
+			if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+				t.Fatalf("Unexpected error dropping %s: %v", table, err)
+			}
+		}
+		dsns[storeTypePostgres] = dsn
+	}
+	return dsns
+}
+
+func sqlDialectFor(storeType string) sqlDialect {
+	if storeType == storeTypePostgres {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+func TestSQLStoreMigrations(t *testing.T) {
+	for name, dsn := range testSQLDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			dialect := sqlDialectFor(name)
+			db, err := sql.Open(dialect.driver, dsn)
+			if err != nil {
+				t.Fatalf("Unexpected error opening database: %v", err)
+			}
+			defer db.Close()
+
+			// Create a database with the schema of the first version,
+			// where rows hold gob-encoded session values
+			latest := sqlMigrations
+			sqlMigrations = latest[:1]
+			err = migrateSQLStore(db, dialect)
+			sqlMigrations = latest
+			if err != nil {
+				t.Fatalf("Unexpected error applying first migration: %+v", err)
+			}
+			var buf bytes.Buffer
+			values := map[interface{}]interface{}{
+				userSessionUserID: "user@example.com",
+				userSessionClaims: map[string]interface{}{"sub": "user-sub"},
+			}
+			if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+				t.Fatalf("Unexpected error encoding values: %v", err)
+			}
+			now := time.Now()
+			insert := fmt.Sprintf("INSERT INTO %s (id, data, created_at, expires_at) VALUES ($1, $2, $3, $4)", sqlSessionsTable)
+			for id, data := range map[string][]byte{"old": buf.Bytes(), "corrupt": []byte("corrupt")} {
+				if _, err := db.Exec(insert, id, data, now.Unix(), now.Add(time.Hour).Unix()); err != nil {
+					t.Fatalf("Unexpected error inserting session: %v", err)
+				}
+			}
+
+			store, err := newSQLStore(dialect, dsn)
+			if err != nil {
+				t.Fatalf("Unexpected error migrating store: %+v", err)
+			}
+			defer store.Close()
+			// Migrations must be idempotent
+			if err := migrateSQLStore(store.db, dialect); err != nil {
+				t.Fatalf("Unexpected error re-running migrations: %+v", err)
+			}
+
+			// Existing sessions are converted to records
+			rec, err := store.Get("old")
+			if err != nil {
+				t.Fatalf("Unexpected error getting converted session: %+v", err)
+			}
+			if rec.Kind != recordKindSession || rec.UserID != "user@example.com" || rec.Values[userSessionUserID] != "user@example.com" {
+				t.Errorf("Session was not converted: %+v", rec)
+			}
+			if rec.ExpiresAt.Unix() != now.Add(time.Hour).Unix() {
+				t.Errorf("Got expiry %v, want %v", rec.ExpiresAt, now.Add(time.Hour))
+			}
+			list, err := store.ListByUser("user@example.com")
+			if err != nil || len(list) != 1 || list[0].ID != "old" {
+				t.Errorf("Converted session is not indexed: %+v, %v", list, err)
+			}
+			// Sessions that can't be decoded are dropped
+			var count int
+			row := store.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = $1", sqlSessionsTable), "corrupt")
+			if err := row.Scan(&count); err != nil || count != 0 {
+				t.Errorf("Corrupt session was not dropped: %d, %v", count, err)
+			}
+		})
+	}
+}
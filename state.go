@@ -3,65 +3,109 @@
 package main
 
 import (
-	"github.com/gorilla/sessions"
-	"github.com/pkg/errors"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
-	"net/http/httptest"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
-const oidcLoginSessionCookie = "non_existent_cookie"
+// stateTTL is how long a user has to complete a login at the IdP.
+const stateTTL = time.Hour
+
+// oidcStateCookiePrefix is the prefix of the cookies that hold the id of a
+// login state in the browser that started the login. The callback only
+// accepts a state that matches its cookie, which prevents login CSRF.
+// Each login has its own cookie, so that logins started in parallel (e.g.
+// in multiple tabs) don't overwrite each other's cookie.
+const oidcStateCookiePrefix = "oidc_state_csrf_"
 
 type state struct {
 	origURL string
+	// nonce is sent in the authorization request and must be returned in
+	// the ID token, to prevent replaying ID tokens into other logins.
+	nonce string
+	// codeVerifier is the PKCE code_verifier of the login, if PKCE is used.
+	codeVerifier string
+	// provider is the name of the provider the user logs in with.
+	provider string
 }
 
 func newState(origURL string) *state {
 	return &state{
 		origURL: origURL,
+		nonce:   createNonce(32),
 	}
 }
 
 // load retrieves a state from the store given its id.
-func load(store sessions.Store, id string) (*state, error) {
-	// Make a fake request so that the store will find the cookie
-	r := &http.Request{Header: make(http.Header)}
-	r.AddCookie(&http.Cookie{Name: oidcLoginSessionCookie, Value: id, MaxAge: 10})
-
-	session, err := store.Get(r, oidcLoginSessionCookie)
+func load(store sessionStore, id string) (*state, error) {
+	rec, err := store.Get(id)
+	if err == errRecordNotFound || (err == nil && rec.Kind != recordKindState) {
+		return nil, errors.New("state does not exist")
+	}
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if session.IsNew {
-		return nil, errors.New("session does not exist")
-	}
 
+	nonce, _ := rec.Values["nonce"].(string)
+	codeVerifier, _ := rec.Values["codeVerifier"].(string)
+	provider, _ := rec.Values["provider"].(string)
 	return &state{
-		origURL: session.Values["origURL"].(string),
+		origURL:      rec.Values["origURL"].(string),
+		nonce:        nonce,
+		codeVerifier: codeVerifier,
+		provider:     provider,
 	}, nil
 }
 
 // save persists a state to the store and returns the entry's id.
-func (s *state) save(store sessions.Store) (string, error) {
-	session := sessions.NewSession(store, oidcLoginSessionCookie)
-	session.ID = createNonce(16)
-	session.Options.MaxAge = int(time.Hour)
-	session.Values["origURL"] = s.origURL
-
-	// The current gorilla/sessions Store interface doesn't allow us
-	// to set the session ID.
-	// Because of that, we have to retrieve it from the cookie value.
-	w := httptest.NewRecorder()
-	err := session.Save(&http.Request{}, w)
-	if err != nil {
-		return "", errors.Wrap(err, "error trying to save session")
+func (s *state) save(store sessionStore) (string, error) {
+	rec := &sessionRecord{
+		ID:   newRecordID(),
+		Kind: recordKindState,
+		Values: map[interface{}]interface{}{
+			"origURL":      s.origURL,
+			"nonce":        s.nonce,
+			"codeVerifier": s.codeVerifier,
+			"provider":     s.provider,
+		},
+		CreatedAt: time.Now(),
 	}
-	// Cookie is persisted in ResponseWriter, make a request to parse it.
-	r := &http.Request{Header: make(http.Header)}
-	r.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
-	c, err := r.Cookie(oidcLoginSessionCookie)
-	if err != nil {
-		return "", errors.Wrap(err, "error trying to save session")
+	if err := store.Put(rec, stateTTL); err != nil {
+		return "", errors.Wrap(err, "error trying to save state")
+	}
+	return rec.ID, nil
+}
+
+// stateCookieName returns the name of the login cookie for the state with the
+// given id.
+func stateCookieName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return oidcStateCookiePrefix + hex.EncodeToString(sum[:8])
+}
+
+// newStateCookie returns the login cookie for the state with the given id.
+func newStateCookie(id string) *http.Cookie {
+	return &http.Cookie{
+		Name:     stateCookieName(id),
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(stateTTL / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		// Lax, so that the cookie is sent on the top-level redirect
+		// from the IdP to the callback.
+		SameSite: http.SameSiteLaxMode,
 	}
-	return c.Value, nil
+}
+
+// deletedStateCookie returns a cookie that removes the login cookie of the
+// state with the given id.
+func deletedStateCookie(id string) *http.Cookie {
+	c := newStateCookie(id)
+	c.Value = ""
+	c.MaxAge = -1
+	return c
 }
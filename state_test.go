@@ -3,16 +3,21 @@
 package main
 
 import (
-	"github.com/quasoft/memstore"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
 )
 
 func TestSaveLoad(t *testing.T) {
 
-	store := memstore.NewMemStore([]byte(secureCookieKeyPair))
+	store := newMemoryStore()
 	state := newState("https://example.com/")
+	state.codeVerifier = newCodeVerifier()
 
 	// Check that save works with no errors
 	id, err := state.save(store)
@@ -31,3 +36,175 @@ func TestSaveLoad(t *testing.T) {
 			loadedState, state)
 	}
 }
+
+func TestCallbackRejectsStateFromOtherBrowser(t *testing.T) {
+	s := &server{backend: newMemoryStore()}
+	id, err := newState("https://example.com/").save(s.backend)
+	if err != nil {
+		t.Fatalf("Unexpected error while saving: %+v", err)
+	}
+
+	// The victim's browser didn't start this login, so it has no login cookie
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login/oidc?code=foo&state="+id, nil)
+	s.callback(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Wrong HTTP StatusCode. Got %v. Expected %v.", w.Code, http.StatusForbidden)
+	}
+	// The state can't be used again
+	if _, err := load(s.backend, id); err == nil {
+		t.Fatal("State was not deleted after the callback")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookieName(id) || cookies[0].MaxAge >= 0 {
+		t.Fatalf("Expected the login cookie to be deleted, got %v", cookies)
+	}
+}
+
+func TestCreateNonce(t *testing.T) {
+	valid := regexp.MustCompile("^[a-zA-Z0-9]*$")
+	seen := map[string]bool{}
+	for _, length := range []int{0, 1, 32, 100} {
+		nonce := createNonce(length)
+		if len(nonce) != length || !valid.MatchString(nonce) {
+			t.Errorf("Got invalid nonce %q of length %d, want length %d", nonce, len(nonce), length)
+		}
+		if length > 0 && seen[nonce] {
+			t.Errorf("Got nonce %q twice", nonce)
+		}
+		seen[nonce] = true
+	}
+}
+
+func TestCallbackNonce(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	p.userIDClaim = "sub"
+	backend := newMemoryStore()
+	s := &server{
+		providers:            []*oidcProvider{p},
+		backend:              backend,
+		store:                newStoreAdapter(backend, 60, []byte("key")),
+		sessionMaxAgeSeconds: 60,
+	}
+
+	// The ID token must have the nonce of the login that it completes
+	login := func(nonce func(st *state) interface{}) *httptest.ResponseRecorder {
+		st := newState("/notebooks")
+		st.provider = p.name
+		id, err := st.save(backend)
+		if err != nil {
+			t.Fatalf("Unexpected error saving state: %+v", err)
+		}
+		claims := map[string]interface{}{
+			"iss": idp.URL,
+			"aud": "authservice",
+			"sub": "alice",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		if n := nonce(st); n != nil {
+			claims["nonce"] = n
+		}
+		idp.tokenResponse = map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, claims),
+		}
+		q := url.Values{"state": {id}, "code": {"code"}}
+		r := httptest.NewRequest("GET", "/login/oidc?"+q.Encode(), nil)
+		r.AddCookie(newStateCookie(id))
+		w := httptest.NewRecorder()
+		s.callback(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name  string
+		nonce func(st *state) interface{}
+	}{
+		{"mismatch", func(*state) interface{} { return createNonce(32) }},
+		{"missing", func(*state) interface{} { return nil }},
+		// e.g. the ID token of another login, replayed
+		{"other login", func(*state) interface{} { return newState("/").nonce }},
+	}
+	for _, test := range tests {
+		if w := login(test.nonce); w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, http.StatusForbidden)
+		}
+		if recs, err := backend.ListBySubject("alice"); err != nil || len(recs) != 0 {
+			t.Errorf("%s: session was created: %+v, %v", test.name, recs, err)
+		}
+	}
+
+	if w := login(func(st *state) interface{} { return st.nonce }); w.Code != http.StatusFound {
+		t.Fatalf("Login with the state's nonce failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if recs, err := backend.ListBySubject("alice"); err != nil || len(recs) != 1 {
+		t.Errorf("Expected a session to be created, got %+v, %v", recs, err)
+	}
+}
+
+func TestCallbackParallelLogins(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	p.userIDClaim = "sub"
+	backend := newMemoryStore()
+	s := &server{
+		providers:            []*oidcProvider{p},
+		backend:              backend,
+		store:                newStoreAdapter(backend, 60, []byte("key")),
+		sessionMaxAgeSeconds: 60,
+	}
+
+	// The same browser starts two logins, e.g. in two tabs
+	var states []string
+	var cookies []*http.Cookie
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		s.startLogin(w, httptest.NewRequest("GET", "/notebooks", nil), p, "/notebooks")
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Unexpected error parsing redirect: %v", err)
+		}
+		states = append(states, location.Query().Get("state"))
+		cookies = append(cookies, w.Result().Cookies()...)
+	}
+	if len(cookies) != 2 || cookies[0].Name == cookies[1].Name {
+		t.Fatalf("Expected a login cookie for each login, got %v", cookies)
+	}
+
+	// Both logins complete, in any order
+	for _, i := range []int{1, 0} {
+		st, err := load(backend, states[i])
+		if err != nil {
+			t.Fatalf("Unexpected error loading state: %+v", err)
+		}
+		idp.tokenResponse = map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token": idp.sign(t, map[string]interface{}{
+				"iss":   idp.URL,
+				"aud":   "authservice",
+				"sub":   "alice",
+				"nonce": st.nonce,
+				"exp":   time.Now().Add(time.Minute).Unix(),
+			}),
+		}
+		q := url.Values{"state": {states[i]}, "code": {"code"}}
+		r := httptest.NewRequest("GET", "/login/oidc?"+q.Encode(), nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s.callback(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("Login %d failed with status %d: %s", i, w.Code, w.Body.String())
+		}
+		// Only the cookie of the completed login is removed
+		for _, c := range w.Result().Cookies() {
+			if c.Name != userSessionCookie && (c.Name != cookies[i].Name || c.MaxAge >= 0) {
+				t.Errorf("Login %d set unexpected cookie %v", i, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/gob"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordKind distinguishes the different things kept in a sessionStore.
+type recordKind string
+
+const (
+	recordKindSession recordKind = "session"
+	recordKindState   recordKind = "state"
+)
+
+// sessionRecord is the unit persisted by a sessionStore. It is either a
+// user session or the state of an in-progress OIDC login.
+type sessionRecord struct {
+	ID     string
+	Kind   recordKind
+	UserID string
+	// Subject and SID are the user's subject and session id at the IdP,
+	// used to find the sessions that a back-channel logout refers to.
+	Subject string
+	SID     string
+	Values  map[interface{}]interface{}
+	// CreatedAt is set by the caller; ExpiresAt is set by Put.
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+var errRecordNotFound = errors.New("record not found")
+
+// sessionStore is the storage backend for user sessions and login state.
+// Implementations must be safe for concurrent use.
+type sessionStore interface {
+	// Get returns the record with the given id, or errRecordNotFound if it
+	// doesn't exist or has expired.
+	Get(id string) (*sessionRecord, error)
+	// Put creates or replaces a record, which expires after ttl.
+	Put(rec *sessionRecord, ttl time.Duration) error
+	// Delete removes the record with the given id. Deleting a record that
+	// doesn't exist is not an error.
+	Delete(id string) error
+	// List returns all unexpired records.
+	List() ([]*sessionRecord, error)
+	// ListByUser returns all unexpired records of the given user.
+	ListByUser(userID string) ([]*sessionRecord, error)
+	// ListBySubject returns all unexpired records with the given IdP subject.
+	ListBySubject(sub string) ([]*sessionRecord, error)
+	// ListBySID returns all unexpired records with the given IdP session id.
+	ListBySID(sid string) ([]*sessionRecord, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// sweeper is implemented by stores that can't expire records on their own
+// and need expired records to be removed periodically.
+type sweeper interface {
+	// sweep removes all expired records and returns how many were removed.
+	sweep() (int, error)
+}
+
+// runSweeper periodically removes expired records until the returned
+// function is called.
+func runSweeper(s sweeper, interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := s.sweep()
+				if err != nil {
+					log.Errorf("Store sweeper failed: %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Debugf("Store sweeper removed %d expired records", n)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// newRecordID returns a random, URL-safe record id.
+func newRecordID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+func encodeRecord(rec *sessionRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, errors.Wrap(err, "error encoding record")
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRecord(data []byte) (*sessionRecord, error) {
+	rec := &sessionRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(rec); err != nil {
+		return nil, errors.Wrap(err, "error decoding record")
+	}
+	return rec, nil
+}
+
+// storeAdapter implements gorilla's sessions.Store on top of a sessionStore.
+// The cookie only carries the (signed) session ID, values are kept in the
+// sessionStore.
+type storeAdapter struct {
+	store  sessionStore
+	codecs []securecookie.Codec
+	// maxAge is the TTL used for sessions that don't set Options.MaxAge.
+	maxAge int
+}
+
+func newStoreAdapter(store sessionStore, maxAge int, keyPairs ...[]byte) *storeAdapter {
+	return &storeAdapter{
+		store:  store,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		maxAge: maxAge,
+	}
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (a *storeAdapter) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(a, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+// If the request has a cookie for a session that exists in the store, the
+// session values are loaded and IsNew is false.
+func (a *storeAdapter) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(a, name)
+	session.Options = &sessions.Options{Path: "/", MaxAge: a.maxAge}
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		// No cookie, this is a new session
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, a.codecs...); err != nil {
+		return session, err
+	}
+	var rec *sessionRecord
+	err = traceStoreOp(r.Context(), "Get", func() (err error) {
+		rec, err = a.store.Get(session.ID)
+		return err
+	})
+	if err == errRecordNotFound {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if rec.Kind != recordKindSession {
+		return session, nil
+	}
+	session.Values = rec.Values
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session in the store and adds the session cookie to the
+// response. A negative MaxAge deletes the session.
+func (a *storeAdapter) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := traceStoreOp(r.Context(), "Delete", func() error { return a.store.Delete(session.ID) })
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	rec := &sessionRecord{
+		ID:        session.ID,
+		Kind:      recordKindSession,
+		Values:    session.Values,
+		CreatedAt: time.Now(),
+	}
+	if userID, ok := session.Values[userSessionUserID].(string); ok {
+		rec.UserID = userID
+	}
+	if sub, ok := session.Values[userSessionSubject].(string); ok {
+		rec.Subject = sub
+	}
+	if sid, ok := session.Values[userSessionSID].(string); ok {
+		rec.SID = sid
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if ttl == 0 {
+		ttl = time.Duration(a.maxAge) * time.Second
+	}
+	if rec.ID == "" {
+		rec.ID = newRecordID()
+	} else {
+		var old *sessionRecord
+		err := traceStoreOp(r.Context(), "Get", func() (err error) {
+			old, err = a.store.Get(rec.ID)
+			return err
+		})
+		if err == nil {
+			// Updating a session (e.g. after refreshing its tokens)
+			// doesn't extend its lifetime.
+			rec.CreatedAt = old.CreatedAt
+			ttl = time.Until(old.ExpiresAt)
+			session.Options.MaxAge = int(ttl / time.Second)
+			// The session expired while it was being handled, e.g.
+			// during a slow token refresh
+			if session.Options.MaxAge <= 0 {
+				session.Options.MaxAge = -1
+				return a.Save(r, w, session)
+			}
+		}
+	}
+	if err := traceStoreOp(r.Context(), "Put", func() error { return a.store.Put(rec, ttl) }); err != nil {
+		return err
+	}
+	session.ID = rec.ID
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, a.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
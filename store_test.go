@@ -0,0 +1,268 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// testStores returns all the sessionStore implementations that can run in
+// the test environment. Redis is tested against REDIS_ADDR if set, or an
+// in-process Redis otherwise. SQL stores use the databases of
+// testSQLDatabases.
+func testStores(t *testing.T) map[string]sessionStore {
+	dir, err := ioutil.TempDir("", "authservice-store")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	stores := map[string]sessionStore{storeTypeMemory: newMemoryStore()}
+	bolt, err := newBoltStore(filepath.Join(dir, "bolt.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating bolt store: %+v", err)
+	}
+	stores[storeTypeBolt] = bolt
+	for name, dsn := range testSQLDatabases(t) {
+		store, err := newSQLStore(sqlDialectFor(name), dsn)
+		if err != nil {
+			t.Fatalf("Unexpected error creating %s store: %+v", name, err)
+		}
+		stores[name] = store
+	}
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = miniredis.RunT(t).Addr()
+	}
+	redis, err := newRedisStore(newRedisPool(addr, os.Getenv("REDIS_PASSWORD"), 0))
+	if err != nil {
+		t.Fatalf("Unexpected error creating redis store: %+v", err)
+	}
+	stores[storeTypeRedis] = redis
+	for _, store := range stores {
+		t.Cleanup(func(store sessionStore) func() {
+			return func() { store.Close() }
+		}(store))
+	}
+	return stores
+}
+
+func TestBoltStoreLegacyBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authservice-store")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bolt.db")
+
+	// A file of the old store, with a session in its bucket
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error opening bolt db: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(legacyBoltBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("session"), []byte("data"))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error writing legacy session: %v", err)
+	}
+	db.Close()
+
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bolt store: %+v", err)
+	}
+	defer store.Close()
+	err = store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(legacyBoltBucketName) != nil {
+			t.Error("Legacy sessions bucket was not deleted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bolt db: %v", err)
+	}
+	if recs, err := store.List(); err != nil || len(recs) != 0 {
+		t.Errorf("Got records %+v, %v, want none", recs, err)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			rec := &sessionRecord{
+				ID:        newRecordID(),
+				Kind:      recordKindSession,
+				UserID:    "user@example.com",
+				Subject:   "user-sub",
+				SID:       "idp-session",
+				Values:    map[interface{}]interface{}{userSessionUserID: "user@example.com"},
+				CreatedAt: time.Now(),
+			}
+			if err := store.Put(rec, time.Minute); err != nil {
+				t.Fatalf("Unexpected error in Put: %+v", err)
+			}
+			got, err := store.Get(rec.ID)
+			if err != nil {
+				t.Fatalf("Unexpected error in Get: %+v", err)
+			}
+			if got.UserID != rec.UserID || got.Values[userSessionUserID] != "user@example.com" {
+				t.Fatalf("Got wrong record: %+v", got)
+			}
+
+			list, err := store.ListByUser("user@example.com")
+			if err != nil {
+				t.Fatalf("Unexpected error in ListByUser: %+v", err)
+			}
+			if len(list) != 1 || list[0].ID != rec.ID {
+				t.Fatalf("Wrong records for user: %+v", list)
+			}
+			list, err = store.ListByUser("other@example.com")
+			if err != nil || len(list) != 0 {
+				t.Fatalf("Expected no records for other user, got %+v, %v", list, err)
+			}
+			list, err = store.ListBySubject("user-sub")
+			if err != nil || len(list) != 1 || list[0].ID != rec.ID {
+				t.Fatalf("Wrong records for subject: %+v, %v", list, err)
+			}
+			list, err = store.ListBySID("idp-session")
+			if err != nil || len(list) != 1 || list[0].ID != rec.ID {
+				t.Fatalf("Wrong records for sid: %+v, %v", list, err)
+			}
+			list, err = store.ListBySID("other-session")
+			if err != nil || len(list) != 0 {
+				t.Fatalf("Expected no records for other sid, got %+v, %v", list, err)
+			}
+
+			if err := store.Delete(rec.ID); err != nil {
+				t.Fatalf("Unexpected error in Delete: %+v", err)
+			}
+			if _, err := store.Get(rec.ID); err != errRecordNotFound {
+				t.Fatalf("Expected errRecordNotFound after Delete, got %v", err)
+			}
+			if err := store.Delete(rec.ID); err != nil {
+				t.Fatalf("Deleting a missing record should succeed, got %+v", err)
+			}
+		})
+	}
+}
+
+func TestSessionStoreExpiry(t *testing.T) {
+	for name, store := range testStores(t) {
+		sw, ok := store.(sweeper)
+		if !ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			expired := &sessionRecord{ID: "expired", Kind: recordKindSession, CreatedAt: time.Now()}
+			valid := &sessionRecord{ID: "valid", Kind: recordKindSession, CreatedAt: time.Now()}
+			if err := store.Put(expired, -time.Second); err != nil {
+				t.Fatalf("Unexpected error in Put: %+v", err)
+			}
+			if err := store.Put(valid, time.Minute); err != nil {
+				t.Fatalf("Unexpected error in Put: %+v", err)
+			}
+			if _, err := store.Get(expired.ID); err != errRecordNotFound {
+				t.Fatalf("Expected errRecordNotFound for expired record, got %v", err)
+			}
+			n, err := sw.sweep()
+			if err != nil {
+				t.Fatalf("Unexpected error sweeping: %+v", err)
+			}
+			if n != 1 {
+				t.Fatalf("Wrong number of swept records. Got %d, expected 1", n)
+			}
+			if _, err := store.Get(valid.ID); err != nil {
+				t.Fatalf("Sweeper removed a record that hasn't expired: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreAdapter(t *testing.T) {
+	backend := newMemoryStore()
+	store := newStoreAdapter(backend, 60, []byte(secureCookieKeyPair))
+
+	session := sessions.NewSession(store, userSessionCookie)
+	session.Values[userSessionUserID] = "user@example.com"
+	w := httptest.NewRecorder()
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	if list, _ := backend.ListByUser("user@example.com"); len(list) != 1 {
+		t.Fatalf("Expected one session for user, got %+v", list)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(r, userSessionCookie)
+	if err != nil {
+		t.Fatalf("Unexpected error loading session: %+v", err)
+	}
+	if loaded.IsNew || loaded.Values[userSessionUserID] != "user@example.com" {
+		t.Fatalf("Expected existing session, got %+v", loaded)
+	}
+
+	// A login state must never be accepted as a user session
+	id, err := newState("/").save(backend)
+	if err != nil {
+		t.Fatalf("Unexpected error saving state: %+v", err)
+	}
+	cookie, err := securecookie.EncodeMulti(userSessionCookie, id, store.codecs...)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding cookie: %v", err)
+	}
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.AddCookie(&http.Cookie{Name: userSessionCookie, Value: cookie})
+	if s, _ := store.New(forged, userSessionCookie); !s.IsNew {
+		t.Fatal("Login state was accepted as a user session")
+	}
+
+	// Deleting the session removes it from the store
+	loaded.Options.MaxAge = -1
+	if err := store.Save(r, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("Unexpected error deleting session: %+v", err)
+	}
+	if _, err := backend.Get(session.ID); err != errRecordNotFound {
+		t.Fatalf("Expected deleted session to be gone, got %v", err)
+	}
+
+	// Updating a session that is about to expire deletes it, instead of
+	// saving it without an expiry
+	expiring := sessions.NewSession(store, userSessionCookie)
+	if err := store.Save(r, httptest.NewRecorder(), expiring); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	rec, err := backend.Get(expiring.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error getting session: %+v", err)
+	}
+	if err := backend.Put(rec, 500*time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+	w = httptest.NewRecorder()
+	if err := store.Save(r, w, expiring); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	if _, err := backend.Get(expiring.ID); err != errRecordNotFound {
+		t.Errorf("Expected expired session to be gone, got %v", err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("Expected the session cookie to be removed, got %v", c)
+	}
+}
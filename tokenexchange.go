@@ -0,0 +1,244 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+)
+
+// Token Exchange grant and token types, see:
+// https://tools.ietf.org/html/rfc8693#section-3
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// The tokens exchanged for the session's access token, keyed by route name
+const userSessionExchangedTokens = "exchangedtokens"
+
+func init() {
+	gob.Register(map[string]oauth2.Token{})
+}
+
+// tokenExchangeConfig lists the routes whose upstream services need a token
+// for their own audience, and is read from TOKEN_EXCHANGE_CONFIG_PATH.
+type tokenExchangeConfig struct {
+	// Routes are matched in order, the first route that matches the request
+	// applies.
+	Routes []tokenExchangeRoute `yaml:"routes"`
+}
+
+type tokenExchangeRoute struct {
+	// Name identifies the exchanged token in the session.
+	Name       string   `yaml:"name"`
+	Hosts      []string `yaml:"hosts"`
+	PathPrefix string   `yaml:"pathPrefix"`
+	// Audience, Resource and Scopes are the parameters of the token
+	// exchange request that describe the token needed upstream.
+	Audience string   `yaml:"audience"`
+	Resource []string `yaml:"resource"`
+	Scopes   []string `yaml:"scopes"`
+	// RequestedTokenType is the type of token to request. Empty lets the
+	// provider choose.
+	RequestedTokenType string `yaml:"requestedTokenType"`
+}
+
+func loadTokenExchangeConfig(path string) (*tokenExchangeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading token exchange config")
+	}
+	return parseTokenExchangeConfig(data)
+}
+
+func parseTokenExchangeConfig(data []byte) (*tokenExchangeConfig, error) {
+	config := &tokenExchangeConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrap(err, "error parsing token exchange config")
+	}
+	names := map[string]bool{}
+	for _, route := range config.Routes {
+		if route.Name == "" {
+			return nil, errors.New("token exchange route doesn't have a name")
+		}
+		if names[route.Name] {
+			return nil, errors.Errorf("duplicate token exchange route %q", route.Name)
+		}
+		names[route.Name] = true
+		if route.Audience == "" && len(route.Resource) == 0 {
+			return nil, errors.Errorf("token exchange route %q must have an audience or a resource", route.Name)
+		}
+	}
+	return config, nil
+}
+
+func (route *tokenExchangeRoute) matches(r *http.Request) bool {
+	if len(route.Hosts) > 0 && !matchHost(route.Hosts, r.Host) {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, route.PathPrefix)
+}
+
+// routeFor returns the route that matches the request, or nil.
+func (c *tokenExchangeConfig) routeFor(r *http.Request) *tokenExchangeRoute {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Routes {
+		if c.Routes[i].matches(r) {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// exchangeToken exchanges the subject's access token for a token described
+// by the route, at the provider's token endpoint.
+// The token exchange procedure is described in RFC8693:
+// https://tools.ietf.org/html/rfc8693
+func exchangeToken(ctx context.Context, p *oidcProvider, route *tokenExchangeRoute, subjectToken string) (token *oauth2.Token, err error) {
+	ctx, span := startSpan(ctx, "oauth2.TokenExchange")
+	defer func() { endSpan(span, err) }()
+
+	values := url.Values{}
+	values.Set("grant_type", grantTypeTokenExchange)
+	values.Set("subject_token", subjectToken)
+	values.Set("subject_token_type", tokenTypeAccessToken)
+	if route.Audience != "" {
+		values.Set("audience", route.Audience)
+	}
+	for _, resource := range route.Resource {
+		values.Add("resource", resource)
+	}
+	if len(route.Scopes) > 0 {
+		values.Set("scope", strings.Join(route.Scopes, " "))
+	}
+	if route.RequestedTokenType != "" {
+		values.Set("requested_token_type", route.RequestedTokenType)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.oauth2Config.Endpoint.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	setClientBasicAuth(req, p.oauth2Config.ClientID, p.oauth2Config.ClientSecret)
+
+	resp, err := doRequest(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error contacting token endpoint")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading token exchange response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &requestError{
+			StatusCode: resp.StatusCode,
+			Err:        errors.New(fmt.Sprintf("Token endpoint returned code %v, server returned: %s", resp.StatusCode, body)),
+		}
+	}
+	res := struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, errors.Wrap(err, "Error parsing token exchange response")
+	}
+	if res.AccessToken == "" {
+		return nil, errors.New("Token exchange response doesn't have an access_token")
+	}
+	token = &oauth2.Token{AccessToken: res.AccessToken, TokenType: res.TokenType}
+	if res.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// exchangedToken returns the session's token for the route, exchanging the
+// session's access token for a new one if there is no cached token or it
+// expires within the leeway. Exchanged tokens are cached in the session, the
+// caller is responsible for saving it if cached is false.
+func (s *server) exchangedToken(ctx context.Context, session *sessions.Session, route *tokenExchangeRoute) (token *oauth2.Token, cached bool, err error) {
+	exchanged, _ := session.Values[userSessionExchangedTokens].(map[string]oauth2.Token)
+	if t, ok := exchanged[route.Name]; ok && t.Expiry.After(time.Now().Add(s.tokenRefreshLeeway)) {
+		return &t, true, nil
+	}
+
+	p := s.sessionProvider(session)
+	if p == nil {
+		return nil, false, errors.New("the provider of the session is no longer configured")
+	}
+	subject, ok := session.Values[userSessionOAuth2Tokens].(oauth2.Token)
+	if !ok || subject.AccessToken == "" {
+		return nil, false, errors.New("session doesn't have an access token")
+	}
+	token, err = exchangeToken(ctx, p, route, subject.AccessToken)
+	if err != nil {
+		return nil, false, err
+	}
+	// Tokens without an expiration are exchanged again on every request
+	if !token.Expiry.IsZero() {
+		updated := map[string]oauth2.Token{}
+		for name, t := range exchanged {
+			updated[name] = t
+		}
+		updated[route.Name] = *token
+		session.Values[userSessionExchangedTokens] = updated
+	}
+	return token, false, nil
+}
+
+// setExchangedToken adds the Authorization header with the exchanged token
+// of the request's route, if any. If the token can't be exchanged, it writes
+// an error response and returns false.
+func (s *server) setExchangedToken(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	route := s.tokenExchange.routeFor(r)
+	if route == nil {
+		return true
+	}
+	logger := loggerForRequest(r)
+	ctx := setTLSContext(r.Context(), s.caBundle)
+	token, cached, err := s.exchangedToken(ctx, session, route)
+	if err != nil {
+		logger.Errorf("Couldn't exchange token for route %q: %v", route.Name, err)
+		// The provider refused to issue a token for this user
+		if reqErr, ok := errors.Cause(err).(*requestError); ok && reqErr.StatusCode >= 400 && reqErr.StatusCode < 500 {
+			requestsTotal.WithLabelValues(outcomeDenied, "token_exchange").Inc()
+			returnStatus(w, http.StatusForbidden, "Token exchange was rejected.")
+			return false
+		}
+		requestsTotal.WithLabelValues(outcomeError, "token_exchange").Inc()
+		returnStatus(w, http.StatusInternalServerError, "Couldn't exchange token.")
+		return false
+	}
+	if !cached && !token.Expiry.IsZero() {
+		if err := session.Save(r, w); err != nil {
+			// The token is still valid for this request
+			logger.Warnf("Couldn't save exchanged token in user session: %v", err)
+		}
+	}
+	// Tokens that aren't access tokens (token_type N_A) are sent as bearer
+	// tokens too
+	tokenType := token.Type()
+	if tokenType == "N_A" {
+		tokenType = "Bearer"
+	}
+	w.Header().Set("Authorization", tokenType+" "+token.AccessToken)
+	return true
+}
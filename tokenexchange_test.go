@@ -0,0 +1,152 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestParseTokenExchangeConfig(t *testing.T) {
+	config, err := parseTokenExchangeConfig([]byte(`
+routes:
+- name: pipelines
+  hosts: ["kubeflow.example.com"]
+  pathPrefix: /pipeline
+  audience: ml-pipeline
+  scopes: [pipelines.read]
+- name: storage
+  resource: ["https://storage.example.com"]
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing config: %+v", err)
+	}
+	tests := []struct {
+		host, path string
+		route      string
+	}{
+		{"kubeflow.example.com", "/pipeline/apis", "pipelines"},
+		{"other.example.com", "/pipeline/apis", "storage"},
+		{"kubeflow.example.com", "/notebooks", "storage"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		if route := config.routeFor(r); route == nil || route.Name != test.route {
+			t.Errorf("%s%s: got route %v, want %q", test.host, test.path, route, test.route)
+		}
+	}
+
+	for _, invalid := range []string{
+		"routes:\n- audience: a\n",
+		"routes:\n- name: a\n",
+		"routes:\n- name: a\n  audience: a\n- name: a\n  audience: b\n",
+		"routes:\n- name: a\n  audiences: [a]\n",
+	} {
+		if _, err := parseTokenExchangeConfig([]byte(invalid)); err == nil {
+			t.Errorf("Invalid config was accepted: %q", invalid)
+		}
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	backend := newMemoryStore()
+	s := &server{
+		providers: []*oidcProvider{p},
+		backend:   backend,
+		store:     newStoreAdapter(backend, 60, []byte("key")),
+		tokenExchange: &tokenExchangeConfig{Routes: []tokenExchangeRoute{
+			{Name: "pipelines", PathPrefix: "/pipeline", Audience: "ml-pipeline", Scopes: []string{"read", "write"}},
+		}},
+		tokenRefreshLeeway: time.Minute,
+	}
+
+	login := httptest.NewRecorder()
+	session, _ := s.store.Get(httptest.NewRequest("GET", "/", nil), userSessionCookie)
+	session.Values[userSessionUserID] = "alice@example.com"
+	session.Values[userSessionClaims] = map[string]interface{}{"sub": "alice"}
+	session.Values[userSessionIDToken] = "idtoken"
+	session.Values[userSessionProvider] = p.name
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{AccessToken: "session-token", Expiry: time.Now().Add(time.Hour)}
+	if err := session.Save(httptest.NewRequest("GET", "/", nil), login); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	cookie := login.Result().Cookies()[0]
+	authenticate := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		return w
+	}
+
+	idp.tokenResponse = map[string]interface{}{
+		"access_token":      "pipelines-token",
+		"issued_token_type": tokenTypeAccessToken,
+		"token_type":        "bearer",
+		"expires_in":        300,
+	}
+	w := authenticate("/pipeline/apis")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Authorization"); got != "Bearer pipelines-token" {
+		t.Errorf("Got Authorization header %q", got)
+	}
+	if len(idp.tokenRequests) != 1 {
+		t.Fatalf("Got %d token requests, want 1", len(idp.tokenRequests))
+	}
+	form := idp.tokenRequests[0]
+	want := map[string]string{
+		"grant_type":         grantTypeTokenExchange,
+		"subject_token":      "session-token",
+		"subject_token_type": tokenTypeAccessToken,
+		"audience":           "ml-pipeline",
+		"scope":              "read write",
+	}
+	for k, v := range want {
+		if got := form.Get(k); got != v {
+			t.Errorf("Got %s %q, want %q", k, got, v)
+		}
+	}
+
+	// The exchanged token is cached in the session
+	if w := authenticate("/pipeline/runs"); w.Header().Get("Authorization") != "Bearer pipelines-token" {
+		t.Errorf("Got Authorization header %q", w.Header().Get("Authorization"))
+	}
+	if len(idp.tokenRequests) != 1 {
+		t.Errorf("Cached token was exchanged again")
+	}
+
+	// Other routes don't get a token
+	if w := authenticate("/notebooks"); w.Code != http.StatusOK || w.Header().Get("Authorization") != "" {
+		t.Errorf("Got status %d and Authorization header %q", w.Code, w.Header().Get("Authorization"))
+	}
+
+	// Once the token is about to expire, it is exchanged again, and the
+	// provider may refuse to
+	rec, err := backend.Get(session.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error getting session: %+v", err)
+	}
+	exchanged := rec.Values[userSessionExchangedTokens].(map[string]oauth2.Token)
+	token := exchanged["pipelines"]
+	token.Expiry = time.Now().Add(time.Second)
+	exchanged["pipelines"] = token
+	if err := backend.Put(rec, time.Minute); err != nil {
+		t.Fatalf("Unexpected error saving session: %+v", err)
+	}
+	idp.tokenStatus = http.StatusBadRequest
+	idp.tokenResponse = map[string]interface{}{"error": "invalid_target"}
+	if w := authenticate("/pipeline/apis"); w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if len(idp.tokenRequests) != 2 {
+		t.Errorf("Expiring token was not exchanged again")
+	}
+}
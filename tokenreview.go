@@ -0,0 +1,267 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// tokenReviewPath is the path of the TokenReview API of the Kubernetes API
+// server.
+// See: https://kubernetes.io/docs/reference/kubernetes-api/authentication-resources/token-review-v1/
+const tokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+// tokenReviewUserIDClaim is the claim of reviewed tokens with the userid.
+const tokenReviewUserIDClaim = "username"
+
+var errTokenNotAuthenticated = errors.New("token is not authenticated")
+
+type tokenReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Spec       tokenReviewSpec    `json:"spec"`
+	Status     *tokenReviewStatus `json:"status,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool                `json:"authenticated"`
+	User          tokenReviewUserInfo `json:"user"`
+	Audiences     []string            `json:"audiences,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+type tokenReviewUserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid"`
+	Groups   []string            `json:"groups"`
+	Extra    map[string][]string `json:"extra"`
+}
+
+// tokenReviewer authenticates Kubernetes ServiceAccount tokens by submitting
+// them to the TokenReview API. Tokens are only reviewed if they are issued by
+// one of the Kubernetes issuers, so that other tokens are never sent to the
+// API server. Results are cached, successful reviews for cacheTTL and failed
+// ones for negativeCacheTTL.
+type tokenReviewer struct {
+	apiURL string
+	// tokenPath is the authservice's own ServiceAccount token, re-read on
+	// every review, as projected tokens are rotated.
+	tokenPath    string
+	audiences    []string
+	issuers      []string
+	groupsHeader string
+	client       *http.Client
+
+	cache         *introspectionCache
+	negativeCache *introspectionCache
+}
+
+func newTokenReviewer(apiURL, tokenPath, caPath string, audiences, issuers []string, groupsHeader string, cacheTTL, negativeCacheTTL time.Duration) (*tokenReviewer, error) {
+	client := http.DefaultClient
+	if caPath != "" {
+		ca, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading Kubernetes CA")
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in Kubernetes CA")
+		}
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+	}
+	return &tokenReviewer{
+		apiURL:        strings.TrimSuffix(apiURL, "/"),
+		tokenPath:     tokenPath,
+		audiences:     audiences,
+		issuers:       issuers,
+		groupsHeader:  groupsHeader,
+		client:        client,
+		cache:         newIntrospectionCache(cacheTTL, introspectionCacheSize),
+		negativeCache: newIntrospectionCache(negativeCacheTTL, introspectionCacheSize),
+	}, nil
+}
+
+// reviews returns true if the token is issued by Kubernetes.
+func (t *tokenReviewer) reviews(rawToken string) bool {
+	if t == nil || !isJWT(rawToken) {
+		return false
+	}
+	issuer, err := unverifiedIssuer(rawToken)
+	if err != nil {
+		return false
+	}
+	for _, i := range t.issuers {
+		if i == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// review returns the claims of the user that the token belongs to, as
+// returned by the TokenReview API. Tokens that the API server doesn't
+// authenticate return errTokenNotAuthenticated.
+func (t *tokenReviewer) review(ctx context.Context, token string) (map[string]interface{}, error) {
+	key := introspectionCacheKey("tokenreview", token)
+	if res, ok := t.cache.get(key); ok {
+		return res.claims, nil
+	}
+	if _, ok := t.negativeCache.get(key); ok {
+		return nil, errTokenNotAuthenticated
+	}
+	claims, err := t.submit(ctx, token)
+	switch {
+	case errors.Cause(err) == errTokenNotAuthenticated:
+		t.negativeCache.put(key, nil)
+	case err == nil:
+		t.cache.put(key, claims)
+	}
+	return claims, err
+}
+
+// submit creates a TokenReview for the token.
+func (t *tokenReviewer) submit(ctx context.Context, token string) (claims map[string]interface{}, err error) {
+	ctx, span := startSpan(ctx, "kubernetes.TokenReview")
+	defer func() { endSpan(span, err) }()
+
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: t.audiences},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.apiURL+tokenReviewPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if t.tokenPath != "" {
+		credential, err := ioutil.ReadFile(t.tokenPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading ServiceAccount token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(credential)))
+	}
+
+	resp, err := doRequest(context.WithValue(ctx, oauth2.HTTPClient, t.client), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error contacting Kubernetes API server")
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading TokenReview response")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, &requestError{
+			StatusCode: resp.StatusCode,
+			Err:        errors.New(fmt.Sprintf("Kubernetes API server returned code %v, server returned: %s", resp.StatusCode, respBody)),
+		}
+	}
+	review := tokenReview{}
+	if err := json.Unmarshal(respBody, &review); err != nil {
+		return nil, errors.Wrap(err, "Error parsing TokenReview response")
+	}
+	if review.Status == nil {
+		return nil, errors.New("TokenReview response doesn't have a status")
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, errors.Wrap(errTokenNotAuthenticated, review.Status.Error)
+		}
+		return nil, errTokenNotAuthenticated
+	}
+	// Authenticators that don't support audiences authenticate the token
+	// for the API server's audience instead, which must not be accepted
+	if len(t.audiences) > 0 && !containsAnyString(t.audiences, review.Status.Audiences) {
+		return nil, errors.Wrapf(errTokenNotAuthenticated, "token is authenticated for audiences %v", review.Status.Audiences)
+	}
+	if review.Status.User.Username == "" {
+		return nil, errors.New("TokenReview response doesn't have a username")
+	}
+	return reviewedUserClaims(review.Status.User), nil
+}
+
+// reviewedUserClaims returns the user info of a TokenReview as claims, so
+// that authorization rules and claim headers apply to ServiceAccounts too.
+func reviewedUserClaims(user tokenReviewUserInfo) map[string]interface{} {
+	groups := []interface{}{}
+	for _, g := range user.Groups {
+		groups = append(groups, g)
+	}
+	claims := map[string]interface{}{
+		"sub":                  user.Username,
+		tokenReviewUserIDClaim: user.Username,
+		"groups":               groups,
+	}
+	if user.UID != "" {
+		claims["uid"] = user.UID
+	}
+	if len(user.Extra) > 0 {
+		extra := map[string]interface{}{}
+		for k, values := range user.Extra {
+			list := []interface{}{}
+			for _, v := range values {
+				list = append(list, v)
+			}
+			extra[k] = list
+		}
+		claims["extra"] = extra
+	}
+	return claims
+}
+
+// tokenReviewClaims authenticates a Kubernetes token with the TokenReview API
+// and returns its claims and the claim with the userid. If the token is
+// rejected, it writes the response and returns false.
+func (s *server) tokenReviewClaims(w http.ResponseWriter, r *http.Request, token string) (map[string]interface{}, string, bool) {
+	logger := loggerForRequest(r)
+	claims, err := s.tokenReviewer.review(r.Context(), token)
+	if errors.Cause(err) == errTokenNotAuthenticated {
+		logger.Infof("Kubernetes token is not authenticated: %v", err)
+		s.bearerRejected(r, "tokenreview_rejected")
+		requestsTotal.WithLabelValues(outcomeUnauthenticated, "invalid_bearer_token").Inc()
+		returnStatus(w, http.StatusUnauthorized, "Token is not authenticated.")
+		return nil, "", false
+	}
+	if err != nil {
+		logger.Errorf("Not able to review token: %v", err)
+		s.bearerRejected(r, "tokenreview_failed")
+		requestsTotal.WithLabelValues(outcomeError, "tokenreview_failed").Inc()
+		returnStatus(w, http.StatusInternalServerError, "Unable to review token.")
+		return nil, "", false
+	}
+	return claims, tokenReviewUserIDClaim, true
+}
+
+// setTokenReviewHeaders adds the groups of a reviewed token to the response.
+func (s *server) setTokenReviewHeaders(w http.ResponseWriter, claims map[string]interface{}) {
+	if s.tokenReviewer.groupsHeader == "" {
+		return
+	}
+	groups, _ := claims["groups"].([]interface{})
+	if len(groups) == 0 {
+		return
+	}
+	w.Header().Set(s.tokenReviewer.groupsHeader, strings.Join(claimValues(groups), ","))
+}
@@ -0,0 +1,180 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer is a Kubernetes API server that only serves the TokenReview
+// API, authenticating the tokens in users.
+type fakeAPIServer struct {
+	*httptest.Server
+	// credential is the token that callers must authenticate with
+	credential string
+	users      map[string]tokenReviewUserInfo
+	// audiences, if set, are the audiences that tokens are authenticated
+	// for. Otherwise, they are authenticated for the requested audiences.
+	audiences []string
+	// status, if set, is the status of all responses
+	status  int
+	reviews []tokenReviewSpec
+}
+
+func newFakeAPIServer(t *testing.T, credential string) *fakeAPIServer {
+	f := &fakeAPIServer{credential: credential, users: map[string]tokenReviewUserInfo{}}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != tokenReviewPath {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+f.credential {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if f.status != 0 {
+			w.WriteHeader(f.status)
+			return
+		}
+		review := tokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.reviews = append(f.reviews, review.Spec)
+		user, ok := f.users[review.Spec.Token]
+		review.Status = &tokenReviewStatus{Authenticated: ok, User: user, Audiences: review.Spec.Audiences}
+		if f.audiences != nil {
+			review.Status.Audiences = f.audiences
+		}
+		if !ok {
+			review.Status.Error = "invalid bearer token"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// reviewer returns a tokenReviewer that uses the fake API server.
+func (f *fakeAPIServer) reviewer(t *testing.T, audiences []string) *tokenReviewer {
+	dir, err := ioutil.TempDir("", "tokenreview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tokenPath := filepath.Join(dir, "token")
+	caPath := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(tokenPath, []byte(f.credential+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw})
+	if err := ioutil.WriteFile(caPath, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reviewer, err := newTokenReviewer(f.URL, tokenPath, caPath, audiences,
+		[]string{"https://kubernetes.default.svc.cluster.local"}, defaultGroupsHeader, time.Minute, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error creating reviewer: %+v", err)
+	}
+	return reviewer
+}
+
+// unsignedJWT returns a JWT with the given claims and an invalid signature.
+func unsignedJWT(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + ".c2ln"
+}
+
+func TestTokenReview(t *testing.T) {
+	apiServer := newFakeAPIServer(t, "authservice-token")
+	s := &server{tokenReviewer: apiServer.reviewer(t, []string{"kubeflow"})}
+	s.userIDOpts.header = defaultUserIDHeader
+
+	saToken := unsignedJWT(map[string]interface{}{"iss": "https://kubernetes.default.svc.cluster.local", "sub": "pipeline-runner"})
+	apiServer.users[saToken] = tokenReviewUserInfo{
+		Username: "system:serviceaccount:kubeflow:pipeline-runner",
+		UID:      "1234",
+		Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:kubeflow"},
+	}
+	authenticate := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/pipeline", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := authenticate(saToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(defaultUserIDHeader); got != "system:serviceaccount:kubeflow:pipeline-runner" {
+			t.Errorf("Got userid header %q", got)
+		}
+		if got := w.Header().Get(defaultGroupsHeader); got != "system:serviceaccounts,system:serviceaccounts:kubeflow" {
+			t.Errorf("Got groups header %q", got)
+		}
+	}
+	if len(apiServer.reviews) != 1 {
+		t.Fatalf("Got %d reviews, want 1 (cached)", len(apiServer.reviews))
+	}
+	if !reflect.DeepEqual(apiServer.reviews[0].Audiences, []string{"kubeflow"}) {
+		t.Errorf("Got review audiences %v", apiServer.reviews[0].Audiences)
+	}
+
+	// Rejected tokens are cached too
+	invalid := unsignedJWT(map[string]interface{}{"iss": "https://kubernetes.default.svc.cluster.local", "sub": "deleted"})
+	for i := 0; i < 2; i++ {
+		if w := authenticate(invalid); w.Code != http.StatusUnauthorized {
+			t.Errorf("Got status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	}
+	if len(apiServer.reviews) != 2 {
+		t.Errorf("Got %d reviews, want 2 (cached)", len(apiServer.reviews))
+	}
+
+	// Errors of the API server are not cached
+	apiServer.status = http.StatusServiceUnavailable
+	other := unsignedJWT(map[string]interface{}{"iss": "https://kubernetes.default.svc.cluster.local", "sub": "other"})
+	if w := authenticate(other); w.Code != http.StatusInternalServerError {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	apiServer.status = 0
+	apiServer.users[other] = tokenReviewUserInfo{Username: "system:serviceaccount:kubeflow:other"}
+	if w := authenticate(other); w.Code != http.StatusOK {
+		t.Errorf("Got status %d after the API server recovered", w.Code)
+	}
+
+	// Tokens authenticated for other audiences are rejected, e.g. by an
+	// authenticator that ignores the requested audiences
+	apiServer.audiences = []string{"https://kubernetes.default.svc.cluster.local"}
+	defaultAudience := unsignedJWT(map[string]interface{}{"iss": "https://kubernetes.default.svc.cluster.local", "sub": "default-audience"})
+	apiServer.users[defaultAudience] = tokenReviewUserInfo{Username: "system:serviceaccount:kubeflow:default-audience"}
+	if w := authenticate(defaultAudience); w.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d for token of another audience, want %d", w.Code, http.StatusUnauthorized)
+	}
+	apiServer.audiences = nil
+
+	// Tokens of other issuers are never sent to the API server
+	if s.tokenReviewer.reviews(unsignedJWT(map[string]interface{}{"iss": "https://accounts.example.com"})) {
+		t.Error("Token of another issuer would be reviewed")
+	}
+	if s.tokenReviewer.reviews("opaque") {
+		t.Error("Opaque token would be reviewed")
+	}
+}
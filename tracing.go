@@ -0,0 +1,105 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/arrikto/oidc-authservice"
+
+// Supported values for OTEL_TRACES_EXPORTER
+const (
+	tracesExporterNone = "none"
+	tracesExporterOTLP = "otlp"
+)
+
+// setupTracing installs the global tracer provider and propagator.
+// Incoming trace context is accepted in both the W3C and the B3 formats.
+// With the "none" exporter spans are not recorded, but trace context is still
+// propagated to the IdP. The OTLP exporter is configured with the standard
+// OTEL_EXPORTER_OTLP_* env variables.
+// The returned function flushes any pending spans.
+func setupTracing(ctx context.Context, exporter string, opts ...otlptracehttp.Option) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader|b3.B3SingleHeader)),
+	))
+
+	switch exporter {
+	case tracesExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case tracesExporterOTLP:
+	default:
+		return nil, errors.Errorf("unknown traces exporter %q", exporter)
+	}
+
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating OTLP trace exporter")
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("oidc-authservice"),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a span as a child of the span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, marking it as failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceStoreOp runs a sessionStore operation in a span. Missing records are
+// not errors for the span, as they are expected.
+func traceStoreOp(ctx context.Context, op string, f func() error) error {
+	_, span := startSpan(ctx, "store."+op)
+	err := f()
+	if err == errRecordNotFound {
+		endSpan(span, nil)
+	} else {
+		endSpan(span, err)
+	}
+	return err
+}
+
+// startServerSpan extracts the trace context of an incoming request and
+// starts a span for handling it. The returned request carries the span.
+func startServerSpan(r *http.Request, name string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPTarget(r.URL.Path),
+			attribute.String("http.host", r.Host),
+		),
+	)
+	return r.WithContext(ctx), span
+}
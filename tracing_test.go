@@ -0,0 +1,84 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracing(t *testing.T) {
+	// Collector stand-in that records the exported spans
+	var mu sync.Mutex
+	spans := map[string]string{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("Invalid export request: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = hex.EncodeToString(span.TraceId)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	shutdown, err := setupTracing(context.Background(), tracesExporterOTLP,
+		otlptracehttp.WithEndpoint(strings.TrimPrefix(collector.URL, "http://")),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up tracing: %v", err)
+	}
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	// The IdP receives the trace context
+	var idpTraceParent string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idpTraceParent = r.Header.Get("traceparent")
+	}))
+	defer idp.Close()
+
+	const traceID = "80f198ee56343ba864fe8b2a57d3eff7"
+	r := httptest.NewRequest("GET", "/app", nil)
+	r.Header.Set("b3", traceID+"-e457b5a2e4d86bd1-1")
+	r, span := startServerSpan(r, "authenticate")
+	req, _ := http.NewRequest(http.MethodPost, idp.URL, nil)
+	if _, err := doRequest(r.Context(), req); err != nil {
+		t.Fatalf("Unexpected error in request: %v", err)
+	}
+	span.End()
+
+	if !strings.Contains(idpTraceParent, traceID) {
+		t.Errorf("IdP got wrong traceparent %q, expected trace %s", idpTraceParent, traceID)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error flushing spans: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"authenticate", "HTTP POST"} {
+		if spans[name] != traceID {
+			t.Errorf("Span %q not exported in trace %s: %v", name, traceID, spans)
+		}
+	}
+}
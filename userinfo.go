@@ -0,0 +1,57 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// idTokenOnlyClaims are the claims about the ID token itself, which UserInfo
+// responses must not replace.
+var idTokenOnlyClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true,
+	"auth_time": true, "nonce": true, "acr": true, "amr": true, "azp": true,
+	"sid": true,
+}
+
+// fetchUserInfo gets the user's claims from the provider's UserInfo endpoint
+// with the access token. The claims must be about the given subject, as
+// described in:
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+func fetchUserInfo(ctx context.Context, p *oidcProvider, token *oauth2.Token, subject string) (claims map[string]interface{}, err error) {
+	ctx, span := startSpan(ctx, "oidc.UserInfo")
+	defer func() { endSpan(span, err) }()
+
+	userInfo, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling UserInfo endpoint")
+	}
+	if userInfo.Subject != subject {
+		return nil, errors.Errorf("UserInfo response has different subject: got %q, expected %q",
+			userInfo.Subject, subject)
+	}
+	claims = map[string]interface{}{}
+	if err := userInfo.Claims(&claims); err != nil {
+		return nil, errors.Wrap(err, "error parsing UserInfo response")
+	}
+	return claims, nil
+}
+
+// mergeUserInfo returns the claims of an ID token with the claims of a
+// UserInfo response added. UserInfo claims replace the ID token's claims about
+// the user, which may be stale, but not its claims about the token itself.
+func mergeUserInfo(claims, userInfo map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range claims {
+		merged[k] = v
+	}
+	for k, v := range userInfo {
+		if !idTokenOnlyClaims[k] {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -0,0 +1,137 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+func TestCallbackUserInfo(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	p.userIDClaim = "email"
+	p.userInfo = true
+	backend := newMemoryStore()
+	s := &server{
+		providers:            []*oidcProvider{p},
+		backend:              backend,
+		store:                newStoreAdapter(backend, 60, []byte("key")),
+		sessionMaxAgeSeconds: 60,
+	}
+
+	// The ID token doesn't have the email and groups claims
+	login := func(userInfo map[string]interface{}) (*httptest.ResponseRecorder, *sessionRecord) {
+		st := newState("/notebooks")
+		st.provider = p.name
+		id, err := st.save(backend)
+		if err != nil {
+			t.Fatalf("Unexpected error saving state: %+v", err)
+		}
+		idp.tokenResponse = map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token": idp.sign(t, map[string]interface{}{
+				"iss":   idp.URL,
+				"aud":   "authservice",
+				"sub":   "alice",
+				"nonce": st.nonce,
+				"exp":   time.Now().Add(time.Minute).Unix(),
+			}),
+		}
+		idp.userInfo = userInfo
+
+		q := url.Values{"state": {id}, "code": {"code"}}
+		r := httptest.NewRequest("GET", "/login/oidc?"+q.Encode(), nil)
+		r.AddCookie(newStateCookie(id))
+		w := httptest.NewRecorder()
+		s.callback(w, r)
+		recs, err := backend.ListBySubject("alice")
+		if err != nil || len(recs) == 0 {
+			return w, nil
+		}
+		return w, recs[0]
+	}
+
+	w, rec := login(map[string]interface{}{
+		"sub":    "alice",
+		"email":  "alice@example.com",
+		"groups": []string{"ml-admins"},
+	})
+	if w.Code != http.StatusFound || rec == nil {
+		t.Fatalf("Login failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if rec.UserID != "alice@example.com" {
+		t.Errorf("Got userid %q, want %q", rec.UserID, "alice@example.com")
+	}
+	claims := rec.Values[userSessionClaims].(map[string]interface{})
+	if !reflect.DeepEqual(claims["groups"], []interface{}{"ml-admins"}) || claims["iss"] != idp.URL {
+		t.Errorf("UserInfo claims were not merged into the ID token claims: %v", claims)
+	}
+	backend.Delete(rec.ID)
+
+	// The UserInfo response must be about the same user
+	if w, rec := login(map[string]interface{}{"sub": "mallory", "email": "mallory@example.com"}); w.Code == http.StatusFound || rec != nil {
+		t.Errorf("Login with UserInfo of another subject succeeded with status %d", w.Code)
+	}
+
+	// Without the userid claim, the login fails instead of panicking
+	if w, rec := login(map[string]interface{}{"sub": "alice"}); w.Code != http.StatusInternalServerError || rec != nil {
+		t.Errorf("Login without userid claim got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRefreshUserInfo(t *testing.T) {
+	idp := newTestProvider(t)
+	p := idp.provider(t, defaultProviderName)
+	p.userInfo = true
+	s := &server{providers: []*oidcProvider{p}}
+
+	session := sessions.NewSession(nil, userSessionCookie)
+	session.Values[userSessionOAuth2Tokens] = oauth2.Token{AccessToken: "old", RefreshToken: "refresh"}
+	session.Values[userSessionClaims] = map[string]interface{}{
+		"sub":    "alice",
+		"exp":    float64(time.Now().Unix()),
+		"groups": []interface{}{"users"},
+	}
+	// The provider doesn't return a new ID token
+	idp.tokenResponse = map[string]interface{}{"access_token": "new", "token_type": "Bearer"}
+	idp.userInfo = map[string]interface{}{"sub": "alice", "groups": []string{"users", "ml-admins"}}
+
+	if err := s.refreshSessionTokens(context.Background(), session); err != nil {
+		t.Fatalf("Unexpected error refreshing tokens: %+v", err)
+	}
+	claims := session.Values[userSessionClaims].(map[string]interface{})
+	if !reflect.DeepEqual(claims["groups"], []interface{}{"users", "ml-admins"}) {
+		t.Errorf("UserInfo claims were not re-fetched: %v", claims)
+	}
+
+	// If the UserInfo claims can't be fetched, the session isn't modified
+	idp.userInfo = map[string]interface{}{"sub": "mallory"}
+	if err := s.refreshSessionTokens(context.Background(), session); err == nil {
+		t.Fatal("Refresh with UserInfo of another subject succeeded")
+	}
+	if token := session.Values[userSessionOAuth2Tokens].(oauth2.Token); token.AccessToken != "new" {
+		t.Errorf("Session tokens were replaced by a failed refresh")
+	}
+}
+
+func TestMergeUserInfo(t *testing.T) {
+	claims := map[string]interface{}{"iss": "https://idp", "sub": "alice", "exp": 1.0, "email": "old@example.com"}
+	userInfo := map[string]interface{}{"sub": "alice", "exp": 2.0, "email": "new@example.com", "groups": []interface{}{"a"}}
+	want := map[string]interface{}{"iss": "https://idp", "sub": "alice", "exp": 1.0, "email": "new@example.com", "groups": []interface{}{"a"}}
+	if got := mergeUserInfo(claims, userInfo); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got claims %v, want %v", got, want)
+	}
+	if claims["email"] != "old@example.com" {
+		t.Error("mergeUserInfo modified the ID token claims")
+	}
+}
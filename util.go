@@ -5,11 +5,15 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 	"golang.org/x/oauth2"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
@@ -76,13 +80,25 @@ func clean(s []string) []string {
 	return res
 }
 
+// createNonce returns a random alphanumeric string, suitable for security
+// sensitive values like the OIDC nonce.
 func createNonce(length int) string {
-	nonceChars := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	var nonce = make([]rune, length)
-	for i := range nonce {
-		nonce[i] = nonceChars[rand.Intn(len(nonceChars))]
+	nonceChars := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+	// Reject bytes above the largest multiple of len(nonceChars), so that
+	// all characters are equally likely.
+	limit := byte(256 - 256%len(nonceChars))
+	nonce := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(nonce) < length {
+		if _, err := rand.Read(buf); err != nil {
+			panic(fmt.Sprintf("crypto/rand failed: %v", err))
+		}
+		for _, b := range buf {
+			if b < limit && len(nonce) < length {
+				nonce = append(nonce, nonceChars[int(b)%len(nonceChars)])
+			}
+		}
 	}
-
 	return string(nonce)
 }
 
@@ -110,7 +126,24 @@ func doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
 	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
 		client = c
 	}
+	ctx, span := startSpan(ctx, "HTTP "+req.Method,
+		semconv.HTTPMethod(req.Method),
+		semconv.HTTPURL(req.URL.String()),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	// TODO: Consider retrying the request if response code is 503
 	// See: https://tools.ietf.org/html/rfc7009#section-2.2.1
-	return client.Do(req.WithContext(ctx))
+	resp, err := client.Do(req.WithContext(ctx))
+	if err == nil {
+		span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// setClientBasicAuth authenticates the request with the client credentials,
+// which are form-encoded before being used as the basic auth user and
+// password, see: https://tools.ietf.org/html/rfc6749#section-2.3.1
+func setClientBasicAuth(req *http.Request, clientID, clientSecret string) {
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
 }
@@ -0,0 +1,34 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSetClientBasicAuth(t *testing.T) {
+	tests := []struct {
+		clientID     string
+		clientSecret string
+	}{
+		{"authservice", "secret"},
+		{"authservice:web", "s3cr:t%+/ é"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/token", nil)
+		setClientBasicAuth(r, test.clientID, test.clientSecret)
+		id, secret, ok := r.BasicAuth()
+		if !ok {
+			t.Fatalf("Request has no basic auth: %v", r.Header)
+		}
+		// The server form-decodes the credentials
+		if got, err := url.QueryUnescape(id); err != nil || got != test.clientID {
+			t.Errorf("Got client ID %q (%v), want %q", got, err, test.clientID)
+		}
+		if got, err := url.QueryUnescape(secret); err != nil || got != test.clientSecret {
+			t.Errorf("Got client secret %q (%v), want %q", got, err, test.clientSecret)
+		}
+	}
+}